@@ -0,0 +1,502 @@
+// Copyright ©2013 The bíogo Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// cuffdiff-pirna relates cuffdiff transcript level changes to piRNA level changes.
+//
+// A cuffdiff gene_exp.diff or isoform_exp.diff table is read and each test is joined to the
+// GFF features whose identifying attribute matches the test_id column. Small RNA reads from
+// the two compared samples are counted against the features of each gene or isoform, split
+// into sense and antisense reads relative to the feature strand, and the log2 change in per
+// million piRNA counts is calculated with a pseudocount of half a read.
+//
+// The joined table is written as TSV and a scatter plot of piRNA change against transcript
+// change is rendered, with significant cuffdiff tests highlighted.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"image/color"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/biogo/biogo/io/featio"
+	"github.com/biogo/biogo/io/featio/gff"
+	"github.com/biogo/biogo/seq"
+	"github.com/biogo/boom"
+	"github.com/biogo/store/interval"
+
+	"github.com/gonum/plot"
+	"github.com/gonum/plot/plotter"
+	"github.com/gonum/plot/vg"
+	"github.com/gonum/plot/vg/draw"
+)
+
+var (
+	in    pair
+	diff  string
+	annot string
+
+	feature string
+	id      string
+
+	out    string
+	plotTo string
+	format string
+	yAxis  string
+
+	mapQ  int
+	mapQb byte
+)
+
+type pair [2]string
+
+func (p *pair) String() string {
+	return fmt.Sprintf("%q,%q", p[0], p[1])
+}
+func (p *pair) Set(value string) error {
+	c := strings.Split(value, ",")
+	switch len(c) {
+	case 0:
+		return errors.New("empty pair")
+	case 2:
+		copy((*p)[:], c)
+		return nil
+	default:
+		return fmt.Errorf("unexpected number of elements: got %d expected 2", len(c))
+	}
+}
+
+func init() {
+	flag.Var(&in, "in", "comma separated pair of small RNA BAM files for cuffdiff sample_1 and sample_2.")
+	flag.StringVar(&diff, "diff", "", "cuffdiff gene_exp.diff or isoform_exp.diff file.")
+	flag.StringVar(&annot, "annot", "", "file name of a GFF file containing gene annotations.")
+	flag.StringVar(&feature, "feature", "exon", "GFF feature type counted for each gene or isoform.")
+	flag.StringVar(&id, "id", "gene_id", "GFF attribute matching the cuffdiff test_id column (transcript_id for isoform tables).")
+	flag.StringVar(&out, "out", "", "joined table outfile name (default stdout).")
+	flag.StringVar(&plotTo, "plot", "", "base name for the scatter plot (default no plot).")
+	flag.StringVar(&format, "format", "svg", "specifies the output format of the figure: eps, jpg, jpeg, pdf, png, svg, and tiff.")
+	flag.StringVar(&yAxis, "y", "antisense", "piRNA change plotted: antisense, sense or total.")
+	flag.IntVar(&mapQ, "mapQ", 0, "minimum mapping quality [0, 255).")
+	help := flag.Bool("help", false, "output this usage message.")
+	flag.Parse()
+	mapQb = byte(mapQ)
+	if *help {
+		flag.Usage()
+		os.Exit(0)
+	}
+	if in[0] == "" || in[1] == "" || diff == "" || annot == "" || mapQ < 0 || mapQ > 254 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	switch yAxis {
+	case "antisense", "sense", "total":
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+	for _, s := range []string{"eps", "jpg", "jpeg", "pdf", "png", "svg", "tiff"} {
+		if format == s {
+			return
+		}
+	}
+	flag.Usage()
+	os.Exit(1)
+}
+
+// test is a cuffdiff test row.
+type test struct {
+	id, gene, locus string
+	status          string
+	value           [2]float64
+	log2FC          float64
+	q               float64
+	significant     bool
+}
+
+// diffColumns are the cuffdiff columns used.
+var diffColumns = []string{
+	"test_id", "gene", "locus", "sample_1", "sample_2", "status",
+	"value_1", "value_2", "log2(fold_change)", "q_value", "significant",
+}
+
+// readDiff returns the tests and sample names described in the cuffdiff table in path.
+func readDiff(path string) ([]test, [2]string, error) {
+	var samples [2]string
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, samples, err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	if !sc.Scan() {
+		err = sc.Err()
+		if err == nil {
+			err = fmt.Errorf("empty cuffdiff file: %s", path)
+		}
+		return nil, samples, err
+	}
+	col := make(map[string]int)
+	for i, h := range strings.Split(sc.Text(), "\t") {
+		col[h] = i
+	}
+	for _, c := range diffColumns {
+		if _, ok := col[c]; !ok {
+			return nil, samples, fmt.Errorf("missing cuffdiff column %q in %s", c, path)
+		}
+	}
+
+	var tests []test
+	for line := 2; sc.Scan(); line++ {
+		fields := strings.Split(sc.Text(), "\t")
+		if len(fields) < len(col) {
+			return nil, samples, fmt.Errorf("short line %d in %s", line, path)
+		}
+		t := test{
+			id:          fields[col["test_id"]],
+			gene:        fields[col["gene"]],
+			locus:       fields[col["locus"]],
+			status:      fields[col["status"]],
+			significant: fields[col["significant"]] == "yes",
+		}
+		for i, c := range []string{"value_1", "value_2"} {
+			t.value[i], err = strconv.ParseFloat(fields[col[c]], 64)
+			if err != nil {
+				return nil, samples, fmt.Errorf("line %d: %v", line, err)
+			}
+		}
+		t.log2FC, err = strconv.ParseFloat(fields[col["log2(fold_change)"]], 64)
+		if err != nil {
+			return nil, samples, fmt.Errorf("line %d: %v", line, err)
+		}
+		t.q, err = strconv.ParseFloat(fields[col["q_value"]], 64)
+		if err != nil {
+			return nil, samples, fmt.Errorf("line %d: %v", line, err)
+		}
+		if samples[0] == "" {
+			samples = [2]string{fields[col["sample_1"]], fields[col["sample_2"]]}
+		}
+		tests = append(tests, t)
+	}
+	return tests, samples, sc.Err()
+}
+
+// gene holds the strand and piRNA counts of a set of features sharing an identifier.
+type gene struct {
+	strand seq.Strand
+
+	// sense and antisense are the number of reads in
+	// each sample overlapping the gene's features.
+	sense, antisense [2]int
+}
+
+type intGff struct {
+	*gff.Feature
+	gene *gene
+	uintptr
+}
+
+func (f intGff) Range() interval.IntRange { return interval.IntRange{f.Start(), f.End()} }
+func (f intGff) Overlap(b interval.IntRange) bool {
+	return f.Feature.FeatEnd > b.Start && f.Feature.FeatStart < b.End
+}
+func (f intGff) ID() uintptr { return f.uintptr }
+
+type intBam struct {
+	*boom.Record
+}
+
+func (f intBam) Range() interval.IntRange { return interval.IntRange{f.Start(), f.End()} }
+func (f intBam) Overlap(b interval.IntRange) bool {
+	return f.Start()+len(f.Seq()) > b.Start && f.Start() < b.End
+}
+func (f intBam) ID() uintptr { return 0 }
+
+// annotGenes returns interval trees of the features of genes named in tests, and
+// the genes keyed by identifier.
+func annotGenes(annot string, tests []test, names []string) ([]interval.IntTree, map[string]*gene, error) {
+	ntab := make(map[string]int, len(names))
+	for i, n := range names {
+		ntab[n] = i
+	}
+
+	ts := make([]interval.IntTree, len(names))
+
+	genes := make(map[string]*gene, len(tests))
+	for _, t := range tests {
+		genes[t.id] = nil
+	}
+
+	f, err := os.Open(annot)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	fs := featio.NewScanner(gff.NewReader(f))
+	for uid := uintptr(0); fs.Next(); uid++ {
+		f := fs.Feat().(*gff.Feature)
+		if f.Feature != feature {
+			continue
+		}
+		gid := strings.Trim(f.FeatAttributes.Get(id), `"`)
+		g, ok := genes[gid]
+		if !ok {
+			continue
+		}
+		if g == nil {
+			g = &gene{strand: f.FeatStrand}
+			genes[gid] = g
+		}
+		if chr, ok := ntab[f.SeqName]; ok {
+			ts[chr].Insert(intGff{f, g, uid}, true)
+		}
+	}
+	if err := fs.Error(); err != nil {
+		return nil, nil, err
+	}
+	for i := range ts {
+		ts[i].AdjustRanges()
+	}
+
+	return ts, genes, nil
+}
+
+func checkNames(files []string) ([]string, error) {
+	var names []string
+	for _, in := range files {
+		bf, err := boom.OpenBAM(in)
+		if err != nil {
+			return nil, err
+		}
+		if names != nil {
+			for i, n := range bf.RefNames() {
+				if names[i] != n {
+					return nil, errors.New("header mismatch")
+				}
+			}
+		}
+		names = bf.RefNames()
+		bf.Close()
+	}
+	return names, nil
+}
+
+// count adds the sense and antisense reads in the BAM file in to sample i of the genes
+// in feats and returns the number of mapped reads passing the mapping quality filter.
+func count(in string, i int, feats []interval.IntTree) (int, error) {
+	fmt.Fprintf(os.Stderr, "Reading %q\n", in)
+	bf, err := boom.OpenBAM(in)
+	if err != nil {
+		return 0, err
+	}
+	defer bf.Close()
+
+	var (
+		total int
+		hit   = make(map[*gene]struct{})
+	)
+	for {
+		r, _, err := bf.Read()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return 0, err
+		}
+		if r.Flags()&boom.Unmapped != 0 || r.Score() < mapQb {
+			continue
+		}
+		total++
+
+		for k := range hit {
+			delete(hit, k)
+		}
+		rs := seq.Plus
+		if r.Flags()&boom.Reverse != 0 {
+			rs = seq.Minus
+		}
+		feats[r.RefID()].DoMatching(func(iv interval.IntInterface) (done bool) {
+			g := iv.(intGff).gene
+			if _, ok := hit[g]; ok {
+				return
+			}
+			hit[g] = struct{}{}
+			switch g.strand {
+			case rs:
+				g.sense[i]++
+			case -rs:
+				g.antisense[i]++
+			}
+			return
+		}, intBam{r})
+	}
+
+	return total, nil
+}
+
+// log2Fold returns the log2 ratio of the per million counts b and a of totals tb and ta
+// calculated with a pseudocount of half a read.
+func log2Fold(a, b, ta, tb int) float64 {
+	if ta == 0 || tb == 0 {
+		return math.NaN()
+	}
+	return math.Log2(((float64(b) + 0.5) / float64(tb)) / ((float64(a) + 0.5) / float64(ta)))
+}
+
+// change returns the log2 sense, antisense and total piRNA changes of g.
+func (g *gene) change(total [2]int) (sense, antisense, all float64) {
+	return log2Fold(g.sense[0], g.sense[1], total[0], total[1]),
+		log2Fold(g.antisense[0], g.antisense[1], total[0], total[1]),
+		log2Fold(g.sense[0]+g.antisense[0], g.sense[1]+g.antisense[1], total[0], total[1])
+}
+
+func main() {
+	tests, samples, err := readDiff(diff)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	refs, err := checkNames(in[:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	feats, genes, err := annotGenes(annot, tests, refs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	var total [2]int
+	for i, f := range in {
+		total[i], err = count(f, i, feats)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	var w io.Writer = os.Stdout
+	if out != "" {
+		f, err := os.Create(out)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		w = f
+	}
+	err = writeTable(w, tests, genes, samples, total)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if plotTo != "" {
+		err = render(tests, genes, total, fmt.Sprintf("%s.%s", plotTo, format))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+}
+
+func writeTable(w io.Writer, tests []test, genes map[string]*gene, samples [2]string, total [2]int) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprint(bw, "test_id\tgene\tlocus\tstrand\tstatus\tvalue_1\tvalue_2\tlog2(fold_change)\tq_value\tsignificant")
+	for _, s := range samples {
+		fmt.Fprintf(bw, "\t%[1]s-sense\t%[1]s-antisense", s)
+	}
+	_, err := fmt.Fprintln(bw, "\tsense-log2-change\tantisense-log2-change\ttotal-log2-change")
+	if err != nil {
+		return err
+	}
+	var missing int
+	for _, t := range tests {
+		g := genes[t.id]
+		if g == nil {
+			missing++
+			continue
+		}
+		sig := "no"
+		if t.significant {
+			sig = "yes"
+		}
+		fmt.Fprintf(bw, "%s\t%s\t%s\t%s\t%s\t%g\t%g\t%g\t%g\t%s",
+			t.id, t.gene, t.locus, g.strand, t.status, t.value[0], t.value[1], t.log2FC, t.q, sig,
+		)
+		for i := range samples {
+			fmt.Fprintf(bw, "\t%d\t%d", g.sense[i], g.antisense[i])
+		}
+		s, a, all := g.change(total)
+		_, err = fmt.Fprintf(bw, "\t%g\t%g\t%g\n", s, a, all)
+		if err != nil {
+			return err
+		}
+	}
+	if missing != 0 {
+		fmt.Fprintf(os.Stderr, "%d cuffdiff tests without %q features\n", missing, feature)
+	}
+	return bw.Flush()
+}
+
+func render(tests []test, genes map[string]*gene, total [2]int, file string) error {
+	p, err := plot.New()
+	if err != nil {
+		return err
+	}
+	p.X.Label.Text = "transcript log2 fold change"
+	p.Y.Label.Text = fmt.Sprintf("%s piRNA log2 fold change", yAxis)
+	p.Add(plotter.NewGrid())
+
+	var xys [2]plotter.XYs
+	for _, t := range tests {
+		g := genes[t.id]
+		if g == nil || t.status != "OK" || math.IsInf(t.log2FC, 0) || math.IsNaN(t.log2FC) {
+			continue
+		}
+		s, a, all := g.change(total)
+		var y float64
+		switch yAxis {
+		case "antisense":
+			y = a
+		case "sense":
+			y = s
+		case "total":
+			y = all
+		}
+		if math.IsNaN(y) {
+			continue
+		}
+		var i int
+		if t.significant {
+			i = 1
+		}
+		xys[i] = append(xys[i], struct{ X, Y float64 }{t.log2FC, y})
+	}
+
+	for i, c := range []color.NRGBA{{R: 0x80, G: 0x80, B: 0x80, A: 0x80}, {R: 0xe4, G: 0x1a, B: 0x1c, A: 0xb0}} {
+		if len(xys[i]) == 0 {
+			continue
+		}
+		s, err := plotter.NewScatter(xys[i])
+		if err != nil {
+			return err
+		}
+		s.GlyphStyle = draw.GlyphStyle{Color: c, Radius: vg.Points(1.5), Shape: draw.CircleGlyph{}}
+		p.Add(s)
+		p.Legend.Add([]string{"not significant", "significant"}[i], s)
+	}
+	p.Legend.Top = true
+
+	return p.Save(20*vg.Centimeter, 15*vg.Centimeter, file)
+}
@@ -5,11 +5,16 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"math"
 	"os"
+	"path"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -30,9 +35,26 @@ const (
 var (
 	annot string
 	reads,
+	vs,
 	classes set
 	filter int
 	strict bool
+
+	bad string
+
+	format string
+	pretty bool
+
+	ends     string
+	byLength bool
+
+	window int
+
+	age      string
+	ageBins  []float64
+	ageTable string
+
+	treeOut string
 )
 
 type set []string
@@ -53,10 +75,21 @@ func (s *set) Set(value string) error {
 
 func init() {
 	flag.Var(&reads, "reads", "comma separated set of BAM file to be processed.")
+	flag.Var(&vs, "vs", "comma separated set of BAM files of a second group to compare against reads;\n\tif given output is a differential json profile,\n\trequiring -format json and no -bylength.")
+	flag.IntVar(&window, "window", 50, "consensus window width for differential profile tests.")
 	flag.StringVar(&annot, "annot", "", "file name of a GFF file containing annotations.")
 	flag.Var(&classes, "class", "comma separated set of annotation classes to analyse.")
 	flag.IntVar(&filter, "f", 0, "filter on piwi type 0: no filter, 1: primary, 2: secondary.")
 	flag.BoolVar(&strict, "strict", false, "filter rejects ambiguous reads.")
+	flag.StringVar(&bad, "bad", "", "file name to write unparseable repeat annotations to.")
+	flag.StringVar(&ends, "ends", "cover", "positions recorded for each read: cover - all bases, five - 5' end, three - 3' end;\n\tpositions outside the annotated copy are ignored.")
+	flag.BoolVar(&byLength, "bylength", false, "record a position by read length matrix for each repeat type.")
+	flag.StringVar(&format, "format", "scov", "output format: scov - legacy class, type, strand, position, count lines,\n\ttsv - tab separated with normalised counts, json - per repeat type profiles.")
+	flag.BoolVar(&pretty, "pretty", true, "output JSON data indented.")
+	flag.StringVar(&age, "age", "", "repeat age measure used to stratify copies: score - GFF score, or the name of a\n\tGFF attribute holding RepeatMasker divergence. Empty disables stratification.")
+	bins := flag.String("bins", "5,10,15,20,25", "comma separated ascending age bin boundaries.")
+	flag.StringVar(&ageTable, "agetable", "", "file name to write the age stratified per sample repeat type densities to.")
+	flag.StringVar(&treeOut, "tree", "", "file name to write per sample class, family and subfamily rollups of copies and reads to.")
 	help := flag.Bool("help", false, "output this usage message.")
 	flag.Parse()
 	if *help {
@@ -67,6 +100,41 @@ func init() {
 		flag.Usage()
 		os.Exit(1)
 	}
+	switch format {
+	case "scov", "tsv", "json":
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+	switch ends {
+	case "cover", "five", "three":
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+	if window < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if len(vs) != 0 && (format != "json" || byLength) {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if (age == "") != (ageTable == "") {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if treeOut != "" {
+		nodes = make(map[string]*node)
+	}
+	if age != "" {
+		var err error
+		ageBins, err = parseBins(*bins)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
 }
 
 var index = map[string]int{}
@@ -86,6 +154,12 @@ func min(a, b int) int {
 
 type intGff struct {
 	*gff.Feature
+	repeat
+
+	// bin is the age bin of the
+	// copy when age is not empty.
+	bin int
+
 	uintptr
 }
 
@@ -95,7 +169,147 @@ func (f intGff) Overlap(b interval.IntRange) bool {
 }
 func (f intGff) ID() uintptr { return f.uintptr }
 
-func annotFeats(annot string, classes, names []string) ([]interval.IntTree, error) {
+// repeatType holds the annotation details and hit profile of a repeat type.
+type repeatType struct {
+	class string
+
+	// consensus is the length of the
+	// repeat type's consensus sequence.
+	consensus int
+
+	// copies is the number of annotated
+	// genomic copies of the repeat type.
+	copies int
+
+	// reads is the number of reads
+	// overlapping copies of the type.
+	reads int
+
+	counts vector
+
+	// lengths holds the counts for each
+	// read length when byLength is true.
+	lengths map[int]*vector
+
+	// ageCopies and ageBases are the number of
+	// copies and annotated bases in each age bin,
+	// and ageReads holds the number of reads
+	// overlapping copies in each age bin for each
+	// input file when age is not empty.
+	ageCopies []int
+	ageBases  []int
+	ageReads  map[string][]int
+}
+
+// allTypes is the name of the pseudo repeat type used to
+// hold the age stratified totals over all repeat types.
+const allTypes = "*"
+
+// series is a set of counts for a read length.
+// A zero length indicates all read lengths.
+type series struct {
+	length int
+	counts vector
+}
+
+// series returns the counts of t, split by read length if byLength is true.
+func (t *repeatType) series() []series {
+	if !byLength {
+		return []series{{counts: t.counts}}
+	}
+	var lens []int
+	for l := range t.lengths {
+		lens = append(lens, l)
+	}
+	sort.Ints(lens)
+	s := make([]series, len(lens))
+	for i, l := range lens {
+		s[i] = series{length: l, counts: *t.lengths[l]}
+	}
+	return s
+}
+
+// readPositions appends the genomic positions of r to be recorded to dst
+// according to the ends mode.
+func readPositions(dst []int, r *boom.Record) []int {
+	rev := r.Flags()&boom.Reverse != 0
+	switch ends {
+	case "cover":
+		for pos := r.Start(); pos < r.End(); pos++ {
+			dst = append(dst, pos)
+		}
+	case "five":
+		if rev {
+			dst = append(dst, r.End()-1)
+		} else {
+			dst = append(dst, r.Start())
+		}
+	case "three":
+		if rev {
+			dst = append(dst, r.Start())
+		} else {
+			dst = append(dst, r.End()-1)
+		}
+	default:
+		panic("illegal ends")
+	}
+	return dst
+}
+
+// repeat holds the consensus details of a RepeatMasker repeat annotation.
+type repeat struct {
+	name, class string
+
+	// start and end are the one-based consensus
+	// coordinates of the aligned region and left is
+	// the length of the consensus following end.
+	start, end, left int
+}
+
+// parseRepeat parses the RepeatMasker repeat attribute of a feature on the given strand.
+// Plus strand matches are described by name, class, start, end and (left), while
+// complement matches are described by name, class, (left), end and start.
+func parseRepeat(att string, strand seq.Strand) (repeat, error) {
+	fields := strings.Fields(att)
+	if len(fields) != 5 {
+		return repeat{}, fmt.Errorf("unexpected number of repeat fields: %d", len(fields))
+	}
+	r := repeat{name: fields[0], class: fields[1]}
+	var start, end, left string
+	switch strand {
+	case seq.Plus:
+		start, end, left = fields[2], fields[3], fields[4]
+	case seq.Minus:
+		left, end, start = fields[2], fields[3], fields[4]
+	default:
+		return repeat{}, errors.New("unstranded repeat")
+	}
+	if !strings.HasPrefix(left, "(") || !strings.HasSuffix(left, ")") {
+		return repeat{}, fmt.Errorf("missing parentheses in left field: %q", left)
+	}
+	var err error
+	r.start, err = strconv.Atoi(start)
+	if err != nil {
+		return repeat{}, err
+	}
+	r.end, err = strconv.Atoi(end)
+	if err != nil {
+		return repeat{}, err
+	}
+	r.left, err = strconv.Atoi(left[1 : len(left)-1])
+	if err != nil {
+		return repeat{}, err
+	}
+	if r.start < 1 || r.end < r.start || r.left < 0 {
+		return repeat{}, fmt.Errorf("invalid consensus coordinates: start=%d end=%d left=%d", r.start, r.end, r.left)
+	}
+	return r, nil
+}
+
+// consensus returns the length of the repeat's consensus sequence.
+func (r repeat) consensus() int { return r.end + r.left }
+
+func annotFeats(annot string, classes, names []string) ([]interval.IntTree, map[string]*repeatType, error) {
 	ntab := make(map[string]int, len(names))
 	for i, n := range names {
 		ntab[n] = i
@@ -103,14 +317,27 @@ func annotFeats(annot string, classes, names []string) ([]interval.IntTree, erro
 
 	ts := make([]interval.IntTree, len(names))
 
-	cm := make(map[string]struct{})
-	for _, c := range classes {
-		cm[c] = struct{}{}
+	types := make(map[string]*repeatType)
+	if age != "" {
+		types[allTypes] = &repeatType{class: allTypes}
 	}
 
 	f, err := os.Open(annot)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	defer f.Close()
+	var (
+		w    io.Writer
+		nBad int
+	)
+	if bad != "" {
+		bf, err := os.Create(bad)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer bf.Close()
+		w = bf
 	}
 	fs := featio.NewScanner(gff.NewReader(f))
 	for id := uintptr(0); fs.Next(); id++ {
@@ -121,29 +348,100 @@ func annotFeats(annot string, classes, names []string) ([]interval.IntTree, erro
 			// Ignore non-repeat features.
 			continue
 		}
-		repeatFields := strings.Fields(att)
-		class = f.Feature + "/" + repeatFields[1]
-		if _, ok := cm[class]; !ok {
-			last := strings.LastIndex(class, "/")
-			if last == strings.Index(class, "/") {
-				continue
+		rep, err := parseRepeat(att, f.FeatStrand)
+		if err != nil {
+			nBad++
+			if w != nil {
+				_, err = fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%v\n", f.SeqName, f.FeatStart, f.FeatEnd, f.FeatStrand, att, err)
+				if err != nil {
+					return nil, nil, err
+				}
 			}
-			if _, ok := cm[class[:last]]; !ok {
+			continue
+		}
+		var bin int
+		if age != "" {
+			a, err := ageOf(f)
+			if err != nil {
+				nBad++
+				if w != nil {
+					_, err = fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%v\n", f.SeqName, f.FeatStart, f.FeatEnd, f.FeatStrand, att, err)
+					if err != nil {
+						return nil, nil, err
+					}
+				}
 				continue
 			}
+			bin = binOf(a, ageBins)
+		}
+		class = f.Feature + "/" + rep.class + "/" + rep.name
+		if !classMatch(classes, class) {
+			continue
 		}
 		if chr, ok := ntab[f.SeqName]; ok {
-			ts[chr].Insert(intGff{f, id}, true)
+			ts[chr].Insert(intGff{f, rep, bin, id}, true)
+			if nodes != nil {
+				for _, a := range ancestors(class) {
+					n, ok := nodes[a]
+					if !ok {
+						n = &node{}
+						nodes[a] = n
+					}
+					n.copies++
+					n.bases += f.Len()
+				}
+			}
+
+			t, ok := types[rep.name]
+			if !ok {
+				t = &repeatType{class: rep.class}
+				types[rep.name] = t
+			}
+			t.copies++
+			if l := rep.consensus(); l > t.consensus {
+				t.consensus = l
+			}
+			if age != "" {
+				for _, t := range []*repeatType{t, types[allTypes]} {
+					if t.ageCopies == nil {
+						t.ageCopies = make([]int, len(ageBins)+1)
+						t.ageBases = make([]int, len(ageBins)+1)
+					}
+					t.ageCopies[bin]++
+					t.ageBases[bin] += f.Len()
+				}
+			}
 		}
 	}
 	if err := fs.Error(); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	for i := range ts {
 		ts[i].AdjustRanges()
 	}
+	if nBad != 0 {
+		fmt.Fprintf(os.Stderr, "skipped %d unparseable repeat annotations\n", nBad)
+	}
 
-	return ts, nil
+	return ts, types, nil
+}
+
+// classMatch returns whether the slash separated feature class path, or any of its
+// ancestors, matches one of the glob patterns in classes. Repeat class paths include
+// the repeat family and subfamily, for example repeat/LINE/L1/L1Md_T, so repeat/LINE
+// matches all LINE elements and repeat/*/ERV* matches ERV families of any class.
+func classMatch(classes []string, class string) bool {
+	for i := 0; i <= len(class); i++ {
+		if i < len(class) && class[i] != '/' {
+			continue
+		}
+		for _, c := range classes {
+			if ok, _ := path.Match(c, class[:i]); ok {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 type intBam struct {
@@ -230,28 +528,108 @@ func (v *vector) inc(i int, s seq.Strand) {
 }
 
 func main() {
-	names, err := checkNames(reads)
+	names, err := checkNames(append(append(set(nil), reads...), vs...))
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 
-	feats, err := annotFeats(annot, classes, names)
+	feats, types, err := annotFeats(annot, classes, names)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 
-	vm := make(map[string]*vector)
-	fm := make(map[string]string)
+	total, err := profileReads(reads, feats, types)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 
-	for _, in := range reads {
-		fmt.Fprintf(os.Stderr, "Reading %q\n", in)
-		bf, err := boom.OpenBAM(in)
+	if len(vs) != 0 {
+		vsTypes := cloneTypes(types)
+		vsTotal, err := profileReads(vs, feats, vsTypes)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if ageTable != "" {
+			err = writeAgeTable(ageTable, []ageGroup{{"reads", reads, types}, {"vs", vs, vsTypes}})
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
+		if treeOut != "" {
+			err = writeTree(treeOut, append(append([]string(nil), reads...), vs...))
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
+		w := bufio.NewWriter(os.Stdout)
+		err = writeDiffJSON(w, [2]map[string]*repeatType{types, vsTypes}, [2]int{total, vsTotal})
+		if err == nil {
+			err = w.Flush()
+		}
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
+		return
+	}
+
+	if ageTable != "" {
+		err = writeAgeTable(ageTable, []ageGroup{{"reads", reads, types}})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if treeOut != "" {
+		err = writeTree(treeOut, reads)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	switch format {
+	case "scov":
+		err = writeSCOV(w, types)
+	case "tsv":
+		err = writeTSV(w, types, total)
+	case "json":
+		err = writeJSON(w, types, total)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// profileReads adds the consensus profiles of the reads in files to the repeat types in
+// types and returns the number of mapped reads passing the filter.
+func profileReads(files []string, feats []interval.IntTree, types map[string]*repeatType) (int, error) {
+	// total is the number of mapped reads passing the filter.
+	var total int
+	var (
+		hit       []string
+		hitAge    []typeBin
+		hitNodes  []string
+		positions []int
+	)
+
+	for _, in := range files {
+		fmt.Fprintf(os.Stderr, "Reading %q\n", in)
+		bf, err := boom.OpenBAM(in)
+		if err != nil {
+			return 0, err
+		}
 
 	loop:
 		for {
@@ -260,8 +638,8 @@ func main() {
 				if err == io.EOF {
 					break
 				}
-				fmt.Fprintln(os.Stderr, err)
-				os.Exit(1)
+				bf.Close()
+				return 0, err
 			}
 
 			switch filter {
@@ -285,29 +663,62 @@ func main() {
 			}
 
 			if r.Flags()&boom.Unmapped == 0 {
+				total++
+				sampleReads[in]++
+				hit = hit[:0]
+				hitAge = hitAge[:0]
+				hitNodes = hitNodes[:0]
+				positions = readPositions(positions[:0], r)
 				feats[r.RefID()].DoMatching(func(iv interval.IntInterface) (done bool) {
 					f := iv.(intGff)
-					repeatFields := strings.Fields(f.FeatAttributes.Get("repeat"))
-					if len(repeatFields) == 0 {
-						return
+					t := types[f.name]
+					if !contains(hit, f.name) {
+						t.reads++
+						hit = append(hit, f.name)
 					}
-					from, err := strconv.Atoi(repeatFields[2])
-					if err != nil {
-						panic(err)
+					if nodes != nil {
+						for _, a := range ancestors(f.Feature + "/" + f.class + "/" + f.name) {
+							if contains(hitNodes, a) {
+								continue
+							}
+							nodes[a].addRead(in)
+							hitNodes = append(hitNodes, a)
+						}
 					}
-					v, ok := vm[repeatFields[0]]
-					if !ok {
-						v = &vector{}
-						vm[repeatFields[0]] = v
-						fm[repeatFields[0]] = repeatFields[1]
+					if age != "" {
+						for _, tb := range []typeBin{{f.name, f.bin}, {allTypes, f.bin}} {
+							if containsBin(hitAge, tb) {
+								continue
+							}
+							types[tb.name].addAgeRead(in, tb.bin)
+							hitAge = append(hitAge, tb)
+						}
 					}
-					for pos := r.Start(); pos < r.End(); pos++ {
+					v := &t.counts
+					var lv *vector
+					if byLength {
+						if t.lengths == nil {
+							t.lengths = make(map[int]*vector)
+						}
+						l := len(r.Seq())
+						lv = t.lengths[l]
+						if lv == nil {
+							lv = &vector{}
+							t.lengths[l] = lv
+						}
+					}
+					for _, pos := range positions {
+						// Bases outside the copy have no
+						// aligned consensus position.
+						if pos < f.FeatStart || f.FeatEnd <= pos {
+							continue
+						}
 						var loc int
 						switch f.FeatStrand {
 						case seq.Plus:
-							loc = pos - f.FeatStart + from
+							loc = pos - f.FeatStart + f.start
 						case seq.Minus:
-							loc = f.FeatEnd - pos + from
+							loc = f.FeatEnd - 1 - pos + f.start
 						default:
 							return
 						}
@@ -318,6 +729,9 @@ func main() {
 							st = f.FeatStrand
 						}
 						v.inc(loc, st)
+						if lv != nil {
+							lv.inc(loc, st)
+						}
 					}
 					return
 				}, intBam{r})
@@ -327,14 +741,686 @@ func main() {
 		bf.Close()
 	}
 
-	for typ, vec := range vm {
-		for pos, val := range *vec {
-			if val[0] != 0 {
-				fmt.Printf("%s\t%s\tminus\t%d\t%d\n", fm[typ], typ, pos, val[0])
+	return total, nil
+}
+
+// sampleReads holds the number of mapped reads
+// passing the filter for each input file.
+var sampleReads = make(map[string]int)
+
+// typeBin is a repeat type and age bin pair.
+type typeBin struct {
+	name string
+	bin  int
+}
+
+func containsBin(s []typeBin, e typeBin) bool {
+	for _, v := range s {
+		if v == e {
+			return true
+		}
+	}
+	return false
+}
+
+// addAgeRead records a read from the named input file overlapping a copy of t in the given age bin.
+func (t *repeatType) addAgeRead(file string, bin int) {
+	if t.ageReads == nil {
+		t.ageReads = make(map[string][]int)
+	}
+	c, ok := t.ageReads[file]
+	if !ok {
+		c = make([]int, len(ageBins)+1)
+		t.ageReads[file] = c
+	}
+	c[bin]++
+}
+
+// cloneTypes returns a copy of the annotation details of types with empty profiles.
+func cloneTypes(types map[string]*repeatType) map[string]*repeatType {
+	c := make(map[string]*repeatType, len(types))
+	for n, t := range types {
+		c[n] = &repeatType{
+			class:     t.class,
+			consensus: t.consensus,
+			copies:    t.copies,
+			ageCopies: t.ageCopies,
+			ageBases:  t.ageBases,
+		}
+	}
+	return c
+}
+
+// diffWindow is a consensus window of a differential profile.
+type diffWindow struct {
+	Start  int     `json:"start"`
+	End    int     `json:"end"`
+	Strand string  `json:"strand"`
+	Counts [2]int  `json:"counts"`
+	Ratio  float64 `json:"log-ratio"`
+
+	// P is the binomial test p-value and Q is
+	// the Benjamini-Hochberg adjusted p-value
+	// over all windows.
+	P float64 `json:"p"`
+	Q float64 `json:"q"`
+}
+
+type diffProfile struct {
+	Class     string `json:"class"`
+	Type      string `json:"type"`
+	Consensus int    `json:"consensus"`
+	Copies    int    `json:"copies"`
+	Reads     [2]int `json:"reads"`
+
+	// Difference is the per million difference of the
+	// second group from the first and LogRatio is the
+	// log2 ratio of the second group to the first.
+	Difference strandCounts `json:"difference"`
+	LogRatio   strandCounts `json:"log-ratio"`
+
+	Windows []diffWindow `json:"windows"`
+}
+
+// writeDiffJSON writes the differential profiles of the two groups of repeat
+// types with the given total mapped read counts.
+func writeDiffJSON(w io.Writer, types [2]map[string]*repeatType, total [2]int) error {
+	r := struct {
+		Files   []string `json:"files"`
+		Vs      []string `json:"vs"`
+		Classes []string `json:"classes"`
+		Filter  int      `json:"filter"`
+		Strict  bool     `json:"strict"`
+		Ends    string   `json:"ends"`
+		Reads   [2]int   `json:"reads"`
+		Window  int      `json:"window"`
+
+		Profiles []diffProfile `json:"profiles"`
+	}{
+		Files:   reads,
+		Vs:      vs,
+		Classes: classes,
+		Filter:  filter,
+		Strict:  strict,
+		Ends:    ends,
+		Reads:   total,
+		Window:  window,
+	}
+
+	// p is the expected proportion of counts
+	// in the second group under the null.
+	p := float64(total[1]) / float64(total[0]+total[1])
+
+	seen := make(map[string]bool)
+	var names []string
+	for _, typ := range append(sortedTypes(types[0]), sortedTypes(types[1])...) {
+		if !seen[typ] {
+			seen[typ] = true
+			names = append(names, typ)
+		}
+	}
+	sort.Sort(byClass{names, types[0]})
+
+	for _, typ := range names {
+		t := [2]*repeatType{types[0][typ], types[1][typ]}
+		n := t[0].length()
+		if l := t[1].length(); l > n {
+			n = l
+		}
+		d := diffProfile{
+			Class:      t[0].class,
+			Type:       typ,
+			Consensus:  t[0].consensus,
+			Copies:     t[0].copies,
+			Reads:      [2]int{t[0].reads, t[1].reads},
+			Difference: strandCounts{Minus: make([]float64, n), Plus: make([]float64, n)},
+			LogRatio:   strandCounts{Minus: make([]float64, n), Plus: make([]float64, n)},
+		}
+		for s, name := range strands {
+			var diff, ratio []float64
+			if s == 0 {
+				diff, ratio = d.Difference.Minus, d.LogRatio.Minus
+			} else {
+				diff, ratio = d.Difference.Plus, d.LogRatio.Plus
+			}
+			for pos := 0; pos < n; pos++ {
+				a, b := t[0].counts.at(pos, s), t[1].counts.at(pos, s)
+				diff[pos] = perMillion(b, total[1]) - perMillion(a, total[0])
+				ratio[pos] = logRatio(a, b, total)
+			}
+			for start := 0; start < n; start += window {
+				end := start + window
+				if end > n {
+					end = n
+				}
+				var c [2]int
+				for pos := start; pos < end; pos++ {
+					c[0] += t[0].counts.at(pos, s)
+					c[1] += t[1].counts.at(pos, s)
+				}
+				if c[0]+c[1] == 0 {
+					continue
+				}
+				d.Windows = append(d.Windows, diffWindow{
+					Start:  start,
+					End:    end,
+					Strand: name,
+					Counts: c,
+					Ratio:  logRatio(c[0], c[1], total),
+					P:      binomialTest(float64(c[1]), float64(c[0]+c[1]), p),
+				})
+			}
+		}
+		r.Profiles = append(r.Profiles, d)
+	}
+	var ws []*diffWindow
+	for i := range r.Profiles {
+		for j := range r.Profiles[i].Windows {
+			ws = append(ws, &r.Profiles[i].Windows[j])
+		}
+	}
+	adjust(ws)
+
+	var (
+		b   []byte
+		err error
+	)
+	if pretty {
+		b, err = json.MarshalIndent(r, "", "  ")
+	} else {
+		b, err = json.Marshal(r)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
+
+// adjust sets the Benjamini-Hochberg adjusted p-values of ws.
+func adjust(ws []*diffWindow) {
+	sort.Sort(byP(ws))
+	n := float64(len(ws))
+	q := 1.
+	for i := len(ws) - 1; i >= 0; i-- {
+		q = math.Min(q, ws[i].P*n/float64(i+1))
+		ws[i].Q = q
+	}
+}
+
+type byP []*diffWindow
+
+func (w byP) Len() int           { return len(w) }
+func (w byP) Less(i, j int) bool { return w[i].P < w[j].P }
+func (w byP) Swap(i, j int)      { w[i], w[j] = w[j], w[i] }
+
+// at returns the count at position pos on strand s, or zero if pos is beyond
+// the end of v.
+func (v vector) at(pos, s int) int {
+	if pos >= len(v) {
+		return 0
+	}
+	return v[pos][s]
+}
+
+// logRatio returns the log2 ratio of library size normalised counts b to a, with
+// a pseudocount of 0.5 added to each.
+func logRatio(a, b int, total [2]int) float64 {
+	if total[0] == 0 || total[1] == 0 {
+		return 0
+	}
+	return math.Log2(((float64(b) + 0.5) / float64(total[1])) / ((float64(a) + 0.5) / float64(total[0])))
+}
+
+// binomialTest returns the two-sided p-value for observing k successes in n trials with
+// success probability p. Large samples use the normal approximation with continuity
+// correction.
+func binomialTest(k, n, p float64) float64 {
+	if n == 0 || p <= 0 || p >= 1 {
+		return 1
+	}
+	if n*p*(1-p) > 25 {
+		z := (math.Abs(k-n*p) - 0.5) / math.Sqrt(n*p*(1-p))
+		if z < 0 {
+			return 1
+		}
+		return math.Erfc(z / math.Sqrt2)
+	}
+
+	obs := binomialLogPMF(k, n, p)
+	var pv float64
+	for i := 0.; i <= n; i++ {
+		if lp := binomialLogPMF(i, n, p); lp <= obs+1e-7 {
+			pv += math.Exp(lp)
+		}
+	}
+	return math.Min(pv, 1)
+}
+
+func binomialLogPMF(k, n, p float64) float64 {
+	lc := lgamma(n+1) - lgamma(k+1) - lgamma(n-k+1)
+	return lc + k*math.Log(p) + (n-k)*math.Log1p(-p)
+}
+
+func lgamma(x float64) float64 {
+	l, _ := math.Lgamma(x)
+	return l
+}
+
+func contains(s []string, e string) bool {
+	for _, v := range s {
+		if v == e {
+			return true
+		}
+	}
+	return false
+}
+
+// sortedTypes returns the names of repeat types with reads in types sorted
+// by class and then type name.
+func sortedTypes(types map[string]*repeatType) []string {
+	var names []string
+	for n, t := range types {
+		if t.reads != 0 {
+			names = append(names, n)
+		}
+	}
+	sort.Sort(byClass{names, types})
+	return names
+}
+
+type byClass struct {
+	names []string
+	types map[string]*repeatType
+}
+
+func (b byClass) Len() int { return len(b.names) }
+func (b byClass) Less(i, j int) bool {
+	ci, cj := b.types[b.names[i]].class, b.types[b.names[j]].class
+	if ci != cj {
+		return ci < cj
+	}
+	return b.names[i] < b.names[j]
+}
+func (b byClass) Swap(i, j int) { b.names[i], b.names[j] = b.names[j], b.names[i] }
+
+// length returns the length of the profile of t, the greater of the
+// consensus length and the highest hit position.
+func (t *repeatType) length() int {
+	if len(t.counts) > t.consensus {
+		return len(t.counts)
+	}
+	return t.consensus
+}
+
+var strands = [...]string{"minus", "plus"}
+
+// perMillion returns v normalised to counts per million of total reads.
+func perMillion(v, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(v) * 1e6 / float64(total)
+}
+
+func writeSCOV(w io.Writer, types map[string]*repeatType) error {
+	for _, typ := range sortedTypes(types) {
+		t := types[typ]
+		for _, ser := range t.series() {
+			for pos, val := range ser.counts {
+				for s, v := range val {
+					if v == 0 {
+						continue
+					}
+					var err error
+					if byLength {
+						_, err = fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%d\n", t.class, typ, strands[s], pos, v, ser.length)
+					} else {
+						_, err = fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\n", t.class, typ, strands[s], pos, v)
+					}
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func writeTSV(w io.Writer, types map[string]*repeatType, total int) error {
+	length := ""
+	if byLength {
+		length = "\tlength"
+	}
+	_, err := fmt.Fprintf(w, "class\ttype\tconsensus\tcopies\treads\tstrand%s\tposition\tcount\tper-million\tper-copy\n", length)
+	if err != nil {
+		return err
+	}
+	for _, typ := range sortedTypes(types) {
+		t := types[typ]
+		for _, ser := range t.series() {
+			if byLength {
+				length = fmt.Sprintf("\t%d", ser.length)
+			}
+			for s := range strands {
+				for pos, val := range ser.counts {
+					v := val[s]
+					if v == 0 {
+						continue
+					}
+					_, err = fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%s%s\t%d\t%d\t%g\t%g\n",
+						t.class, typ, t.consensus, t.copies, t.reads, strands[s], length, pos, v,
+						perMillion(v, total), float64(v)/float64(t.copies),
+					)
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+type strandCounts struct {
+	Minus []float64 `json:"minus"`
+	Plus  []float64 `json:"plus"`
+}
+
+type profile struct {
+	Class     string `json:"class"`
+	Type      string `json:"type"`
+	Consensus int    `json:"consensus"`
+	Copies    int    `json:"copies"`
+	Reads     int    `json:"reads"`
+
+	Counts     strandCounts `json:"counts"`
+	PerMillion strandCounts `json:"per-million"`
+	PerCopy    strandCounts `json:"per-copy"`
+
+	ByLength []lengthProfile `json:"by-length,omitempty"`
+}
+
+type lengthProfile struct {
+	Length int          `json:"length"`
+	Counts strandCounts `json:"counts"`
+}
+
+func writeJSON(w io.Writer, types map[string]*repeatType, total int) error {
+	r := struct {
+		Files   []string `json:"files"`
+		Classes []string `json:"classes"`
+		Filter  int      `json:"filter"`
+		Strict  bool     `json:"strict"`
+		Ends    string   `json:"ends"`
+		Reads   int      `json:"reads"`
+
+		Profiles []profile `json:"profiles"`
+	}{
+		Files:   reads,
+		Classes: classes,
+		Filter:  filter,
+		Strict:  strict,
+		Ends:    ends,
+		Reads:   total,
+	}
+	for _, typ := range sortedTypes(types) {
+		t := types[typ]
+		p := profile{
+			Class:     t.class,
+			Type:      typ,
+			Consensus: t.consensus,
+			Copies:    t.copies,
+			Reads:     t.reads,
+		}
+		n := t.length()
+		p.Counts = strandCounts{Minus: make([]float64, n), Plus: make([]float64, n)}
+		p.PerMillion = strandCounts{Minus: make([]float64, n), Plus: make([]float64, n)}
+		p.PerCopy = strandCounts{Minus: make([]float64, n), Plus: make([]float64, n)}
+		for pos, val := range t.counts {
+			p.Counts.Minus[pos] = float64(val[0])
+			p.Counts.Plus[pos] = float64(val[1])
+			p.PerMillion.Minus[pos] = perMillion(val[0], total)
+			p.PerMillion.Plus[pos] = perMillion(val[1], total)
+			p.PerCopy.Minus[pos] = float64(val[0]) / float64(t.copies)
+			p.PerCopy.Plus[pos] = float64(val[1]) / float64(t.copies)
+		}
+		if byLength {
+			for _, ser := range t.series() {
+				lp := lengthProfile{
+					Length: ser.length,
+					Counts: strandCounts{Minus: make([]float64, n), Plus: make([]float64, n)},
+				}
+				for pos, val := range ser.counts {
+					lp.Counts.Minus[pos] = float64(val[0])
+					lp.Counts.Plus[pos] = float64(val[1])
+				}
+				p.ByLength = append(p.ByLength, lp)
+			}
+		}
+		r.Profiles = append(r.Profiles, p)
+	}
+
+	var (
+		b   []byte
+		err error
+	)
+	if pretty {
+		b, err = json.MarshalIndent(r, "", "  ")
+	} else {
+		b, err = json.Marshal(r)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
+
+// parseBins returns the ascending bin boundaries described by the comma separated list in s.
+func parseBins(s string) ([]float64, error) {
+	var b []float64
+	for _, f := range strings.Split(s, ",") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil {
+			return nil, err
+		}
+		if len(b) != 0 && v <= b[len(b)-1] {
+			return nil, fmt.Errorf("age bins not ascending: %s", s)
+		}
+		b = append(b, v)
+	}
+	return b, nil
+}
+
+// ageOf returns the age measure of f, either the GFF score or the value
+// of the attribute named by age.
+func ageOf(f *gff.Feature) (float64, error) {
+	if age == "score" {
+		if f.FeatScore == nil {
+			return 0, errors.New("missing score")
+		}
+		return *f.FeatScore, nil
+	}
+	att := strings.Trim(f.FeatAttributes.Get(age), `"`)
+	if att == "" {
+		return 0, fmt.Errorf("missing %s attribute", age)
+	}
+	return strconv.ParseFloat(att, 64)
+}
+
+// binOf returns the index of the bin holding v given the bin boundaries in edges.
+// Bin i holds values in [edges[i-1], edges[i]).
+func binOf(v float64, edges []float64) int {
+	return sort.Search(len(edges), func(i int) bool { return v < edges[i] })
+}
+
+// binBounds returns the lower and upper bounds of bin i for the boundaries in edges.
+func binBounds(i int, edges []float64) (lower, upper float64) {
+	lower, upper = math.Inf(-1), math.Inf(1)
+	if i > 0 {
+		lower = edges[i-1]
+	}
+	if i < len(edges) {
+		upper = edges[i]
+	}
+	return lower, upper
+}
+
+// ageGroup is a named set of input files and their repeat type profiles.
+type ageGroup struct {
+	name  string
+	files []string
+	types map[string]*repeatType
+}
+
+// writeAgeTable writes the per age bin read density of each repeat type for each
+// input file in groups to the named file. The pseudo type "*" holds totals over
+// all repeat types.
+func writeAgeTable(path string, groups []ageGroup) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	_, err = fmt.Fprintln(w, "group\tsample\tclass\ttype\tbin\tlower\tupper\tcopies\tbases\treads\tper-copy\tper-million\trpkm")
+	if err != nil {
+		f.Close()
+		return err
+	}
+	for _, g := range groups {
+		var names []string
+		for n, t := range g.types {
+			if t.ageCopies != nil {
+				names = append(names, n)
 			}
-			if val[1] != 0 {
-				fmt.Printf("%s\t%s\tplus\t%d\t%d\n", fm[typ], typ, pos, val[1])
+		}
+		sort.Sort(byClass{names, g.types})
+		for _, in := range g.files {
+			total := sampleReads[in]
+			for _, typ := range names {
+				t := g.types[typ]
+				hits := t.ageReads[in]
+				for bin, copies := range t.ageCopies {
+					if copies == 0 {
+						continue
+					}
+					var n int
+					if hits != nil {
+						n = hits[bin]
+					}
+					lower, upper := binBounds(bin, ageBins)
+					var rpkm float64
+					if total != 0 {
+						rpkm = float64(n) * 1e9 / (float64(total) * float64(t.ageBases[bin]))
+					}
+					_, err = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%g\t%g\t%d\t%d\t%d\t%g\t%g\t%g\n",
+						g.name, in, t.class, typ, bin, lower, upper, copies, t.ageBases[bin], n,
+						float64(n)/float64(copies), perMillion(n, total)/float64(copies), rpkm,
+					)
+					if err != nil {
+						f.Close()
+						return err
+					}
+				}
+			}
+		}
+	}
+	err = w.Flush()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// node holds the rolled up copy and read counts of a level of the class hierarchy.
+type node struct {
+	copies int
+	bases  int
+
+	// reads holds the number of reads overlapping
+	// copies below the node for each input file.
+	reads map[string]int
+}
+
+// nodes holds the class hierarchy rollups keyed by class path
+// when a tree output is requested.
+var nodes map[string]*node
+
+func (n *node) addRead(file string) {
+	if n.reads == nil {
+		n.reads = make(map[string]int)
+	}
+	n.reads[file]++
+}
+
+// ancestors returns the slash separated class path and each of its ancestors, root first.
+func ancestors(class string) []string {
+	var a []string
+	for i := 0; i < len(class); i++ {
+		if class[i] == '/' {
+			a = append(a, class[:i])
+		}
+	}
+	return append(a, class)
+}
+
+// byPath sorts class paths so that each node precedes its descendants.
+type byPath []string
+
+func (p byPath) Len() int { return len(p) }
+func (p byPath) Less(i, j int) bool {
+	a, b := strings.Split(p[i], "/"), strings.Split(p[j], "/")
+	for k := 0; k < len(a) && k < len(b); k++ {
+		if a[k] != b[k] {
+			return a[k] < b[k]
+		}
+	}
+	return len(a) < len(b)
+}
+func (p byPath) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+
+// writeTree writes the rolled up copy and read counts of each level of the class
+// hierarchy for each input file in files to the named file.
+func writeTree(path string, files []string) error {
+	paths := make([]string, 0, len(nodes))
+	for p := range nodes {
+		paths = append(paths, p)
+	}
+	sort.Sort(byPath(paths))
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	_, err = fmt.Fprintln(w, "sample\tdepth\tpath\tname\tcopies\tbases\treads\tper-million\tper-copy")
+	if err != nil {
+		f.Close()
+		return err
+	}
+	for _, in := range files {
+		total := sampleReads[in]
+		for _, p := range paths {
+			n := nodes[p]
+			depth := strings.Count(p, "/")
+			v := n.reads[in]
+			_, err = fmt.Fprintf(w, "%s\t%d\t%s\t%s%s\t%d\t%d\t%d\t%g\t%g\n",
+				in, depth, p, strings.Repeat("  ", depth), p[strings.LastIndex(p, "/")+1:],
+				n.copies, n.bases, v, perMillion(v, total), float64(v)/float64(n.copies),
+			)
+			if err != nil {
+				f.Close()
+				return err
 			}
 		}
 	}
+	err = w.Flush()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
 }
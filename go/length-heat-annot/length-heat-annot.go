@@ -27,6 +27,7 @@ import (
 	"io"
 	"math"
 	"os"
+	"path"
 	"strings"
 	"unsafe"
 )
@@ -195,11 +196,6 @@ func filterFeats(annot string, classes []string, bam string) ([]interval.IntTree
 
 	ts := make([]interval.IntTree, len(names))
 
-	cm := make(map[string]struct{})
-	for _, c := range classes {
-		cm[c] = struct{}{}
-	}
-
 	f, err := os.Open(annot)
 	if err != nil {
 		return nil, err
@@ -210,18 +206,13 @@ func filterFeats(annot string, classes []string, bam string) ([]interval.IntTree
 		var class string
 		if att := f.FeatAttributes.Get(f.Feature); att != "" {
 			// This gets the repeat attributes only.
-			class = f.Feature + "/" + strings.Fields(att)[1]
+			fields := strings.Fields(att)
+			class = f.Feature + "/" + fields[1] + "/" + fields[0]
 		} else {
 			class = f.Feature
 		}
-		if _, ok := cm[class]; !ok {
-			last := strings.LastIndex(class, "/")
-			if last == strings.Index(class, "/") {
-				continue
-			}
-			if _, ok := cm[class[:last]]; !ok {
-				continue
-			}
+		if !classMatch(classes, class) {
+			continue
 		}
 		if chr, ok := ntab[f.SeqName]; ok {
 			ts[chr].Insert(intGff{f}, true)
@@ -237,6 +228,21 @@ func filterFeats(annot string, classes []string, bam string) ([]interval.IntTree
 	return ts, nil
 }
 
+// classMatch returns whether class or any of its ancestors matches a glob in classes.
+func classMatch(classes []string, class string) bool {
+	for i := 0; i <= len(class); i++ {
+		if i < len(class) && class[i] != '/' {
+			continue
+		}
+		for _, c := range classes {
+			if ok, _ := path.Match(c, class[:i]); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 type intBam struct {
 	*boom.Record
 }
@@ -10,8 +10,9 @@
 //  - pool alignment lengths (short and long);
 //  - piRNA type filtering;
 //  - mapping quality filtering;
-//  - long pool piRNA deduplication by denesting reads; and
-//  - short alignment containment.
+//  - long pool piRNA deduplication by denesting reads;
+//  - short alignment containment; and
+//  - restriction to annotation classes.
 //
 // Approach
 //
@@ -50,26 +51,80 @@
 // When contain is requested as an option (the default), long alignments are only considered for
 // comparison to a short alignment when they completely overlap the short alignment and are longer
 // than the short alignment.
+//
+// Joint offsets
+//
+// In addition to the independent 5' and 3' end offset distributions, the joint distribution of
+// 5' and 3' offsets is recorded for each pair. This distinguishes short alignments that are 3'
+// truncated with an intact 5' end from those shifted at both ends. The joint distributions are
+// written as csv and json and rendered as a heatmap for each pair.
+//
+// Per-locus reports
+//
+// The loci option writes a BED6+ table for each pair so that the most truncated piRNA loci
+// can be identified and intersected with annotations. In pairs mode each matched long/short
+// alignment pair is written with the short alignment coordinates, lengths and offsets. In long
+// mode each matched long alignment is written with the number of short reads and distinct
+// truncated forms matching it and their mean 5' and 3' offsets.
+//
+// Annotation classes
+//
+// If a GFF file of annotations and a set of annotation classes are given, the analysis is
+// repeated for each class with both long and short pools restricted to alignments overlapping
+// features of that class. Classes are matched as in length-heat-annot-diff, so a class such
+// as "repeat/LINE" also matches its sub-classes. Per-class rows are written to the csv files
+// with an additional Class column and plots are written for each class.
+//
+// Bootstrap
+//
+// Confidence intervals for the offset distributions of each pair are estimated by bootstrap
+// resampling of either short reads or long alignment loci. Each short read, or each long
+// alignment with all its matching short reads, contributes its matched 5' and 3' offsets as a
+// single resampling unit. Percentile intervals for the relative frequency of each offset and for
+// the mean 5' and 3' offsets are written as csv and drawn as error bars on the barchart.
+//
+// Memory use
+//
+// Unique long alignments are held as compact spans recording only their location, with the
+// strand given by the index holding them. Spans are indexed either by an interval tree or, with
+// lower memory use, by a sorted array. Multiple pairs and classes may be processed concurrently.
+//
+// Length matrix
+//
+// In matrix mode every short alignment length is compared against every longer alignment
+// length between the short minimum and long maximum lengths, so that the lengths at which
+// truncation begins can be identified. Only long alignments longer than the short alignment
+// are considered. The 5' and 3' offset distributions for each short and long length are written
+// as csv along with grids of the mean offsets.
 package main
 
 import (
 	"code.google.com/p/biogo.boom"
 	"code.google.com/p/biogo.store/interval"
+	"code.google.com/p/biogo/io/featio"
+	"code.google.com/p/biogo/io/featio/gff"
 
-	"code.google.com/p/plotinum/plot"
-	"code.google.com/p/plotinum/plotter"
-	"code.google.com/p/plotinum/plotutil"
-	"code.google.com/p/plotinum/vg"
-	"code.google.com/p/plotinum/vg/vgsvg"
+	"github.com/gonum/plot"
+	"github.com/gonum/plot/plotter"
+	"github.com/gonum/plot/plotutil"
+	"github.com/gonum/plot/vg"
+	"github.com/gonum/plot/vg/draw"
 
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"image/color"
 	"io"
+	"math"
+	"math/rand"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"unsafe"
 )
 
 const (
@@ -87,6 +142,25 @@ var (
 
 	pairs pair
 	out   string
+	loci  string
+
+	index  string
+	procs  int
+	matrix bool
+
+	format string
+	title  string
+
+	xMin, xMax float64
+	yMin, yMax float64
+
+	bootstrap int
+	unit      string
+	level     float64
+	seed      int64
+
+	annot   string
+	classes classSet
 
 	longMinLength int
 	longMaxLength int
@@ -132,6 +206,29 @@ func (p *pair) Set(value string) error {
 	return nil
 }
 
+type classSet []string
+
+func (s *classSet) String() string {
+	if len(*s) == 0 {
+		return `""`
+	}
+	return strings.Join(*s, ",")
+}
+func (s *classSet) Set(value string) error {
+	*s = append(*s, strings.Split(value, ",")...)
+	if len(*s) == 0 {
+		return errors.New("empty set")
+	}
+	return nil
+}
+
+func annotOK(annot string, classes []string) bool {
+	if annot == "" && len(classes) == 0 {
+		return true
+	}
+	return annot != "" && len(classes) != 0
+}
+
 const readLength = 50
 
 func max(a, b int) int {
@@ -144,6 +241,22 @@ func max(a, b int) int {
 func init() {
 	flag.Var(&pairs, "pair", "either a comma-separated pair of BAM files (long first) to be\n\tprocessed, or a single BAM file to be used for long and short.\n\t(may be invoked multiple times.)")
 	flag.StringVar(&out, "out", "", "base name for output files.")
+	flag.StringVar(&index, "index", "tree", "long read index: tree - interval tree, array - sorted array.")
+	flag.IntVar(&procs, "procs", 1, "number of pairs to process concurrently.")
+	flag.BoolVar(&matrix, "matrix", false, "compare every short length against every longer length\n\tbetween shortmin and longmax.")
+	flag.IntVar(&bootstrap, "bootstrap", 0, "number of bootstrap replicates for confidence intervals (0 for none).")
+	flag.StringVar(&unit, "unit", "reads", "bootstrap resampling unit: reads - short reads, loci - long alignments.")
+	flag.Float64Var(&level, "level", 0.95, "bootstrap confidence level.")
+	flag.Int64Var(&seed, "seed", 1, "bootstrap random seed.")
+	flag.StringVar(&format, "format", "svg", "specifies the output format of plots: eps, jpg, jpeg, pdf, png, svg, and tiff.")
+	flag.StringVar(&title, "title", "", "title for barchart and boxplot output (default describes filter).")
+	flag.Float64Var(&xMin, "xmin", 0, "minimum offset shown in barchart and boxplot if not equal to xmax.")
+	flag.Float64Var(&xMax, "xmax", 0, "maximum offset shown in barchart and boxplot if not equal to xmin.")
+	flag.Float64Var(&yMin, "ymin", 0, "minimum relative frequency shown in barchart and boxplot if not equal to ymax.")
+	flag.Float64Var(&yMax, "ymax", 0, "maximum relative frequency shown in barchart and boxplot if not equal to ymin.")
+	flag.StringVar(&annot, "annot", "", "file name of a GFF file containing annotations.")
+	flag.Var(&classes, "class", "comma separated set of annotation classes to analyse.")
+	flag.StringVar(&loci, "loci", "", "write per-locus report: pairs - each matched long/short pair,\n\tlong - summary for each matched long read.")
 
 	flag.IntVar(&shortMinLength, "shortmin", 23, "minimum length short read considered.")
 	flag.IntVar(&shortMaxLength, "shortmax", 27, "maximum length short read considered.")
@@ -170,11 +283,53 @@ func init() {
 		flag.Usage()
 		os.Exit(0)
 	}
-	if len(pairs) == 0 || out == "" || mapQ < 0 || mapQ > 254 {
+	if len(pairs) == 0 || out == "" || !annotOK(annot, classes) || mapQ < 0 || mapQ > 254 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	switch loci {
+	case "", "pairs", "long":
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+	switch index {
+	case "tree", "array":
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+	if procs < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	switch unit {
+	case "reads", "loci":
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+	if bootstrap < 0 || level <= 0 || level >= 1 {
 		flag.Usage()
 		os.Exit(1)
 	}
+	if matrix {
+		if shortMinLength >= longMaxLength {
+			flag.Usage()
+			os.Exit(1)
+		}
+		longMinLength = shortMinLength + 1
+		shortMaxLength = longMaxLength - 1
+	}
 	maxLength = max(shortMaxLength, longMaxLength)
+
+	for _, s := range []string{"eps", "jpg", "jpeg", "pdf", "png", "svg", "tiff"} {
+		if format == s {
+			return
+		}
+	}
+	flag.Usage()
+	os.Exit(1)
 }
 
 func qualOk(r *boom.Record, minId, minQ int, minAvQ float64) (ok bool) {
@@ -250,36 +405,244 @@ type readSetElement struct {
 	refid, start, length int
 }
 
-type read struct {
-	*boom.Record
+// span is a compact representation of a unique long alignment. The strand of
+// the alignment is given by the index holding the span.
+type span struct {
+	start, end int
+
 	id uintptr
 }
 
-func (r read) Range() interval.IntRange { return interval.IntRange{r.Start(), r.End()} }
-func (r read) Overlap(b interval.IntRange) bool {
+func (s span) Range() interval.IntRange { return interval.IntRange{s.start, s.end} }
+func (s span) Overlap(b interval.IntRange) bool {
 	// Half-open interval indexing.
-	return r.End() > b.Start && r.Start() < b.End
+	return s.end > b.Start && s.start < b.End
+}
+func (s span) ID() uintptr { return s.id }
+
+type containedSpan struct {
+	span
+}
+
+func (s containedSpan) Overlap(b interval.IntRange) bool {
+	// Return whether s is contained within b such that s is shorter than b.
+	return (s.start > b.Start && s.end <= b.End) || (s.start >= b.Start && s.end < b.End)
+}
+
+// longIndex is a searchable set of long alignment spans on a single strand.
+type longIndex interface {
+	// overlapping returns the spans overlapping q.
+	overlapping(q span) []span
+	// containing returns the spans completely containing q
+	// that are longer than q.
+	containing(q span) []span
+}
+
+// treeIndex is a longIndex backed by an interval tree.
+type treeIndex struct {
+	interval.IntTree
+}
+
+func newTreeIndex(ss []span) *treeIndex {
+	t := &treeIndex{}
+	for _, s := range ss {
+		t.Insert(s, true)
+	}
+	t.AdjustRanges()
+
+	if denest {
+		var rm []interval.IntInterface
+		t.Do(func(iv interval.IntInterface) (done bool) {
+			if len(t.Get(containedSpan{iv.(span)})) > 0 {
+				rm = append(rm, iv)
+			}
+			return
+		})
+
+		for _, iv := range rm {
+			t.Delete(iv, true)
+		}
+		t.AdjustRanges()
+	}
+
+	return t
+}
+
+func (t *treeIndex) overlapping(q span) []span { return spans(t.Get(q)) }
+func (t *treeIndex) containing(q span) []span  { return spans(t.Get(containedSpan{q})) }
+
+func spans(ivs []interval.IntInterface) []span {
+	if len(ivs) == 0 {
+		return nil
+	}
+	s := make([]span, len(ivs))
+	for i, iv := range ivs {
+		s[i] = iv.(span)
+	}
+	return s
+}
+
+// arrayIndex is a longIndex backed by an array of spans sorted by start
+// position. Searches depend on no span being longer than longMaxLength.
+type arrayIndex []span
+
+func newArrayIndex(ss []span) arrayIndex {
+	a := arrayIndex(ss)
+	sort.Sort(a)
+
+	if denest {
+		var kept arrayIndex
+		for _, s := range a {
+			if len(a.containing(s)) == 0 {
+				kept = append(kept, s)
+			}
+		}
+		a = kept
+	}
+
+	return a
+}
+
+func (a arrayIndex) Len() int { return len(a) }
+func (a arrayIndex) Less(i, j int) bool {
+	if a[i].start != a[j].start {
+		return a[i].start < a[j].start
+	}
+	return a[i].end < a[j].end
+}
+func (a arrayIndex) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+
+// first returns the index of the first span that may overlap q.
+func (a arrayIndex) first(q span) int {
+	return sort.Search(len(a), func(i int) bool { return a[i].start > q.start-longMaxLength })
+}
+
+func (a arrayIndex) overlapping(q span) []span {
+	var o []span
+	for i := a.first(q); i < len(a) && a[i].start < q.end; i++ {
+		if a[i].end > q.start {
+			o = append(o, a[i])
+		}
+	}
+	return o
+}
+
+func (a arrayIndex) containing(q span) []span {
+	var o []span
+	c := containedSpan{q}
+	for i := a.first(q); i < len(a) && a[i].start <= q.start; i++ {
+		if c.Overlap(a[i].Range()) {
+			o = append(o, a[i])
+		}
+	}
+	return o
+}
+
+type intGff struct {
+	*gff.Feature
+}
+
+func (f intGff) Range() interval.IntRange { return interval.IntRange{f.Start(), f.End()} }
+func (f intGff) Overlap(b interval.IntRange) bool {
+	return f.Feature.FeatEnd > b.Start && f.Feature.FeatStart < b.End
+}
+func (f intGff) ID() uintptr { return *(*uintptr)(unsafe.Pointer(f.Feature)) }
+
+func refNames(path string) ([]string, error) {
+	bf, err := boom.OpenBAM(path)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", err, path)
+	}
+	defer bf.Close()
+	return bf.RefNames(), nil
+}
+
+// equalNames returns whether a and b hold the same reference names.
+func equalNames(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func filterFeats(annot string, classes, names []string) ([]interval.IntTree, error) {
+	ntab := make(map[string]int, len(names))
+	for i, n := range names {
+		ntab[n] = i
+	}
+
+	ts := make([]interval.IntTree, len(names))
+
+	f, err := os.Open(annot)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fs := featio.NewScanner(gff.NewReader(f))
+	for fs.Next() {
+		f := fs.Feat().(*gff.Feature)
+		var class string
+		if att := f.FeatAttributes.Get(f.Feature); att != "" {
+			// This gets the repeat attributes only.
+			fields := strings.Fields(att)
+			class = f.Feature + "/" + fields[1] + "/" + fields[0]
+		} else {
+			class = f.Feature
+		}
+		if !classMatch(classes, class) {
+			continue
+		}
+		if chr, ok := ntab[f.SeqName]; ok {
+			ts[chr].Insert(intGff{f}, true)
+		}
+	}
+	if err := fs.Error(); err != nil {
+		return nil, err
+	}
+	for i := range ts {
+		ts[i].AdjustRanges()
+	}
+
+	return ts, nil
 }
-func (r read) ID() uintptr { return r.id }
-func (r read) End() int    { return r.Start() + len(r.Seq()) }
 
-type containedRead struct {
-	read
+// classMatch returns whether class or any of its ancestors matches a glob in classes.
+func classMatch(classes []string, class string) bool {
+	for i := 0; i <= len(class); i++ {
+		if i < len(class) && class[i] != '/' {
+			continue
+		}
+		for _, c := range classes {
+			if ok, _ := path.Match(c, class[:i]); ok {
+				return true
+			}
+		}
+	}
+	return false
 }
 
-func (r containedRead) Overlap(b interval.IntRange) bool {
-	// Return whether r is contained within b such that r is shorter than b.
-	return (r.Start() > b.Start && r.End() <= b.End) || (r.Start() >= b.Start && r.End() < b.End)
+// inClass returns whether r overlaps a feature in classFilt. If classFilt is nil
+// inClass returns true.
+func inClass(r *boom.Record, classFilt []interval.IntTree) bool {
+	return classFilt == nil || len(classFilt[r.RefID()].Get(span{start: r.Start(), end: r.Start() + len(r.Seq())})) != 0
 }
 
-func longTrees(long string) ([][2]interval.IntTree, error) {
+// longIndices returns the indexes of unique long alignments in the long BAM file for each
+// reference and strand. Long alignments not overlapping a feature in classFilt are ignored
+// unless classFilt is nil.
+func longIndices(long string, classFilt []interval.IntTree) ([][2]longIndex, error) {
 	bf, err := boom.OpenBAM(long)
 	if err != nil {
 		return nil, fmt.Errorf("%v: %v", err, long)
 	}
 	defer bf.Close()
 
-	ts := make([][2]interval.IntTree, bf.Targets())
+	ss := make([][2][]span, bf.Targets())
 	readSet := make(map[readSetElement]struct{})
 loop:
 	for id := uintptr(0); ; id++ {
@@ -323,43 +686,96 @@ loop:
 						return nil, fmt.Errorf("illegal filter %d", filter)
 					}
 
-					ts[r.RefID()][(r.Flags()&boom.Reverse)>>4].Insert(read{Record: r, id: id}, true)
+					if !inClass(r, classFilt) {
+						continue loop
+					}
+
+					st := (r.Flags() & boom.Reverse) >> 4
+					ss[r.RefID()][st] = append(ss[r.RefID()][st], span{
+						start: re.start,
+						end:   re.start + re.length,
+						id:    id,
+					})
 				}
 			}
 		}
 	}
-	for _, t := range ts {
-		for i := range t {
-			t[i].AdjustRanges()
-
-			if denest {
-				var rm []interval.IntInterface
-				t[i].Do(func(iv interval.IntInterface) (done bool) {
-					if len(t[i].Get(containedRead{iv.(read)})) > 0 {
-						rm = append(rm, iv)
-					}
-					return
-				})
+	if err != nil {
+		return nil, err
+	}
 
-				for _, iv := range rm {
-					t[i].Delete(iv, true)
-				}
-				t[i].AdjustRanges()
+	ts := make([][2]longIndex, len(ss))
+	for i, t := range ss {
+		for j, s := range t {
+			switch index {
+			case "tree":
+				ts[i][j] = newTreeIndex(s)
+			case "array":
+				ts[i][j] = newArrayIndex(s)
+			default:
+				panic("illegal index")
 			}
 		}
 	}
 
-	return ts, err
+	return ts, nil
 }
 
 type set struct {
+	// class is the annotation class the
+	// alignments were restricted to.
+	class string
+
 	long     string
 	short    string
 	fiveEnd  []int
 	threeEnd []int
+
+	// joint holds the joint distribution of offsets
+	// indexed by 5' offset and then 3' offset.
+	joint [][]int
+
+	// names holds the reference names of the
+	// short BAM for per-locus reporting.
+	names []string
+
+	// loci holds per long read summaries when
+	// a long mode per-locus report is requested.
+	loci map[locus]*locusSummary
+
+	// units holds the matched 5' and 3' offset indices
+	// of each bootstrap resampling unit.
+	units [][][2]int
+
+	// ci holds bootstrap confidence intervals.
+	ci *bootCI
+
+	// matrix holds the 5' and 3' offset distributions
+	// for each short and long length pair in matrix mode.
+	matrix map[[2]int]*[2][]int
 }
 
-func searchForest(ts [][2]interval.IntTree, contain bool, short string) (set, error) {
+// locus is a long alignment location.
+type locus struct {
+	refid      int
+	start, end int
+	reverse    bool
+}
+
+// locusSummary holds the short alignments matching a long alignment.
+type locusSummary struct {
+	reads int
+	forms map[[2]int]struct{}
+
+	fiveSum  int
+	threeSum int
+}
+
+// searchForest finds the long alignments in ts matching each short alignment in the
+// short BAM file. Short alignments not overlapping a feature in classFilt are ignored
+// unless classFilt is nil. If pairs is not nil, each matched pair is written to it in
+// BED6+ format.
+func searchForest(ts [][2]longIndex, contain bool, short string, classFilt []interval.IntTree, pairs io.Writer) (set, error) {
 	bf, err := boom.OpenBAM(short)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
@@ -370,6 +786,24 @@ func searchForest(ts [][2]interval.IntTree, contain bool, short string) (set, er
 	results := set{
 		fiveEnd:  make([]int, 2*maxLength),
 		threeEnd: make([]int, 2*maxLength),
+		joint:    make([][]int, 2*maxLength),
+		names:    bf.RefNames(),
+	}
+	for i := range results.joint {
+		results.joint[i] = make([]int, 2*maxLength)
+	}
+	if loci == "long" {
+		results.loci = make(map[locus]*locusSummary)
+	}
+	if matrix {
+		results.matrix = make(map[[2]int]*[2][]int)
+	}
+	var (
+		byLocus map[locus][][2]int
+		order   []locus
+	)
+	if bootstrap > 0 && unit == "loci" {
+		byLocus = make(map[locus][][2]int)
 	}
 loop:
 	for {
@@ -409,57 +843,243 @@ loop:
 						}
 					}
 
-					var longs []interval.IntInterface
+					if !inClass(r, classFilt) {
+						continue loop
+					}
+
+					q := span{start: r.Start(), end: r.Start() + len(r.Seq())}
+					var longs []span
 					if contain {
-						// Using containedRead is a little lazy, but we know the short read is shorter
-						// than all the reads in the long tree, so we can use this type.
-						longs = ts[r.RefID()][(r.Flags()&boom.Reverse)>>4].Get(containedRead{read{Record: r}})
+						longs = ts[r.RefID()][(r.Flags()&boom.Reverse)>>4].containing(q)
 					} else {
-						longs = ts[r.RefID()][(r.Flags()&boom.Reverse)>>4].Get(read{Record: r})
+						longs = ts[r.RefID()][(r.Flags()&boom.Reverse)>>4].overlapping(q)
 					}
-					for _, long := range longs {
-						longr := long.(read)
+					var matches [][2]int
+					for _, longr := range longs {
+						if matrix && longr.end-longr.start <= q.end-q.start {
+							continue
+						}
 
 						// These distances result in a shift to the left for shorter short reads.
+						var five, three int
 						if r.Flags()&boom.Reverse == 0 {
-							results.fiveEnd[longr.Start()-r.Start()+maxLength]++
-							results.threeEnd[read{Record: r}.End()-longr.End()+maxLength]++
+							five = longr.start - q.start + maxLength
+							three = q.end - longr.end + maxLength
 						} else {
-							results.fiveEnd[read{Record: r}.End()-longr.End()+maxLength]++
-							results.threeEnd[longr.Start()-r.Start()+maxLength]++
+							five = q.end - longr.end + maxLength
+							three = longr.start - q.start + maxLength
+						}
+						results.fiveEnd[five]++
+						results.threeEnd[three]++
+						results.joint[five][three]++
+
+						if matrix {
+							k := [2]int{q.end - q.start, longr.end - longr.start}
+							m, ok := results.matrix[k]
+							if !ok {
+								m = &[2][]int{make([]int, 2*maxLength), make([]int, 2*maxLength)}
+								results.matrix[k] = m
+							}
+							m[0][five]++
+							m[1][three]++
 						}
+
+						if bootstrap > 0 {
+							switch unit {
+							case "reads":
+								matches = append(matches, [2]int{five, three})
+							case "loci":
+								l := locus{
+									refid:   r.RefID(),
+									start:   longr.start,
+									end:     longr.end,
+									reverse: r.Flags()&boom.Reverse != 0,
+								}
+								if _, ok := byLocus[l]; !ok {
+									order = append(order, l)
+								}
+								byLocus[l] = append(byLocus[l], [2]int{five, three})
+							}
+						}
+
+						if pairs != nil {
+							_, err = fmt.Fprintf(pairs, "%s\t%d\t%d\t.\t0\t%c\t%d\t%d\t%d\t%d\t%d\t%d\n",
+								results.names[r.RefID()], longr.start, longr.end, strand(r),
+								q.start, q.end,
+								longr.end-longr.start, q.end-q.start,
+								five-maxLength, three-maxLength,
+							)
+							if err != nil {
+								return set{}, err
+							}
+						}
+						if results.loci != nil {
+							l := locus{
+								refid:   r.RefID(),
+								start:   longr.start,
+								end:     longr.end,
+								reverse: r.Flags()&boom.Reverse != 0,
+							}
+							ls, ok := results.loci[l]
+							if !ok {
+								ls = &locusSummary{forms: make(map[[2]int]struct{})}
+								results.loci[l] = ls
+							}
+							ls.reads++
+							ls.forms[[2]int{r.Start(), len(r.Seq())}] = struct{}{}
+							ls.fiveSum += five - maxLength
+							ls.threeSum += three - maxLength
+						}
+					}
+					if len(matches) != 0 {
+						results.units = append(results.units, matches)
 					}
 				}
 			}
 		}
 	}
+	for _, l := range order {
+		results.units = append(results.units, byLocus[l])
+	}
 
 	return results, err
 }
 
+// job is a single long/short pair and annotation class analysis.
+type job struct {
+	pair        int
+	long, short string
+	class       string
+
+	// classFilt holds the features of class,
+	// shared between the jobs of all pairs.
+	classFilt []interval.IntTree
+}
+
+func (j job) path() string { return classPath(pairPath(out, j.pair), j.class) }
+
+// analyse performs the analysis described by j, writing any requested per-locus report.
+func analyse(j job) (set, error) {
+	ts, err := longIndices(j.long, j.classFilt)
+	if err != nil {
+		return set{}, err
+	}
+
+	var d set
+	if loci == "pairs" {
+		f, err := os.Create(decorate(j.path(), "loci.bed", filter))
+		if err != nil {
+			return set{}, err
+		}
+		defer f.Close()
+		_, err = fmt.Fprintln(f, "#chrom\tlongStart\tlongEnd\tname\tscore\tstrand\tshortStart\tshortEnd\tlongLength\tshortLength\tfivePrime\tthreePrime")
+		if err != nil {
+			return set{}, err
+		}
+		d, err = searchForest(ts, contain, j.short, j.classFilt, f)
+		if err != nil {
+			return set{}, err
+		}
+	} else {
+		d, err = searchForest(ts, contain, j.short, j.classFilt, nil)
+		if err != nil {
+			return set{}, err
+		}
+	}
+	d.class = j.class
+	d.long = filepath.Base(j.long)
+	d.short = filepath.Base(j.short)
+
+	if loci == "long" {
+		err = longLoci(j.path(), d)
+		if err != nil {
+			return set{}, err
+		}
+		d.loci = nil
+	}
+
+	return d, nil
+}
+
 func main() {
-	var data []set
-	for _, p := range pairs {
-		long, short := p[0], p[1]
+	rnd := rand.New(rand.NewSource(seed))
+
+	cls := []string{""}
+	filts := make(map[string][]interval.IntTree)
+	if annot != "" {
+		cls = classes
+
+		var names []string
+		for _, p := range pairs {
+			for _, f := range p {
+				n, err := refNames(f)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					os.Exit(1)
+				}
+				if names != nil && !equalNames(names, n) {
+					fmt.Fprintf(os.Stderr, "header mismatch: %s\n", f)
+					os.Exit(1)
+				}
+				names = n
+			}
+		}
+		for _, c := range cls {
+			classFilt, err := filterFeats(annot, []string{c}, names)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			filts[c] = classFilt
+		}
+	}
+
+	var jobs []job
+	for i, p := range pairs {
+		for _, c := range cls {
+			jobs = append(jobs, job{pair: i, long: p[0], short: p[1], class: c, classFilt: filts[c]})
+		}
+	}
+
+	var (
+		data = make([]set, len(jobs))
+		errs = make([]error, len(jobs))
 
-		trees, err := longTrees(long)
+		wg    sync.WaitGroup
+		limit = make(chan struct{}, procs)
+	)
+	for i, j := range jobs {
+		wg.Add(1)
+		limit <- struct{}{}
+		go func(i int, j job) {
+			defer func() {
+				<-limit
+				wg.Done()
+			}()
+			data[i], errs[i] = analyse(j)
+		}(i, j)
+	}
+	wg.Wait()
+	for _, err := range errs {
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
+	}
+
+	for i, j := range jobs {
+		if bootstrap > 0 {
+			data[i].ci = resample(data[i], bootstrap, level, rnd)
+			data[i].units = nil
+		}
 
-		d, err := searchForest(trees, contain, short)
-		if err != nil {
+		if err := heatmap(j.path(), data[i]); err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
-		d.long = filepath.Base(long)
-		d.short = filepath.Base(short)
-
-		data = append(data, d)
 
 		if len(pairs) == 1 {
-			if err := barchart(out, d); err != nil {
+			if err := barchart(classPath(out, j.class), data[i]); err != nil {
 				fmt.Fprintln(os.Stderr, err)
 				os.Exit(1)
 			}
@@ -470,13 +1090,41 @@ func main() {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
-
-	if len(data) > 1 {
-		if err := boxplot(out, data); err != nil {
+	if err := jointCSV(out, data); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := jointJSON(out, data); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if matrix {
+		if err := matrixCSV(out, data); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if bootstrap > 0 {
+		if err := bootstrapCSV(out, data); err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
 	}
+
+	if len(pairs) > 1 {
+		for _, c := range cls {
+			var sets []set
+			for _, d := range data {
+				if d.class == c {
+					sets = append(sets, d)
+				}
+			}
+			if err := boxplot(classPath(out, c), sets); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
+	}
 }
 
 func decorate(path, decoration string, filter int) string {
@@ -492,6 +1140,14 @@ func decorate(path, decoration string, filter int) string {
 	}
 }
 
+// ident returns the csv identifying fields for e.
+func ident(e set) string {
+	if annot != "" {
+		return fmt.Sprintf("%s,%s,%s", e.class, e.long, e.short)
+	}
+	return fmt.Sprintf("%s,%s", e.long, e.short)
+}
+
 func csv(path string, data []set) error {
 	if len(data) == 0 {
 		return errors.New("no data")
@@ -503,7 +1159,11 @@ func csv(path string, data []set) error {
 	}
 	defer f.Close()
 
-	_, err = fmt.Fprint(f, "End,Long,Short")
+	if annot != "" {
+		_, err = fmt.Fprint(f, "End,Class,Long,Short")
+	} else {
+		_, err = fmt.Fprint(f, "End,Long,Short")
+	}
 	if err != nil {
 		return err
 	}
@@ -519,7 +1179,7 @@ func csv(path string, data []set) error {
 	}
 
 	for _, e := range data {
-		_, err = fmt.Fprintf(f, "FivePrime,%s,%s", e.long, e.short)
+		_, err = fmt.Fprintf(f, "FivePrime,%s", ident(e))
 		if err != nil {
 			return err
 		}
@@ -529,7 +1189,7 @@ func csv(path string, data []set) error {
 				return err
 			}
 		}
-		_, err = fmt.Fprintf(f, "\nThreePrime,%s,%s", e.long, e.short)
+		_, err = fmt.Fprintf(f, "\nThreePrime,%s", ident(e))
 		if err != nil {
 			return err
 		}
@@ -545,25 +1205,606 @@ func csv(path string, data []set) error {
 	return err
 }
 
-type normalised struct {
-	vals []int
-	sum  float64
+func strand(r *boom.Record) byte {
+	if r.Flags()&boom.Reverse == 0 {
+		return '+'
+	}
+	return '-'
 }
 
-func (n *normalised) Len() int {
-	n.sum = 0
-	for _, v := range n.vals {
-		n.sum += float64(v)
+// longLoci writes a BED6+ summary of the short alignments matching each long alignment
+// sorted by decreasing number of distinct truncated forms.
+func longLoci(path string, data set) error {
+	entries := make(byForms, 0, len(data.loci))
+	for l, ls := range data.loci {
+		entries = append(entries, locusEntry{l, ls})
 	}
-	return len(n.vals)
-}
-func (n *normalised) Value(i int) float64 { return float64(n.vals[i]) / n.sum }
+	sort.Sort(entries)
 
-var titles = [...]string{
-	"Read end offsets - all small RNA",
-	"Read end offsets - primary piRNA",
-	"Read end offsets - secondary piRNA",
-}
+	f, err := os.Create(decorate(path, "loci.bed", filter))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintln(f, "#chrom\tstart\tend\tname\tscore\tstrand\tlength\treads\tforms\tmeanFivePrime\tmeanThreePrime")
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		st := '+'
+		if e.reverse {
+			st = '-'
+		}
+		_, err = fmt.Fprintf(f, "%s\t%d\t%d\t.\t%d\t%c\t%d\t%d\t%d\t%.3f\t%.3f\n",
+			data.names[e.refid], e.start, e.end, len(e.forms), st,
+			e.end-e.start, e.reads, len(e.forms),
+			float64(e.fiveSum)/float64(e.reads), float64(e.threeSum)/float64(e.reads),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type locusEntry struct {
+	locus
+	*locusSummary
+}
+
+type byForms []locusEntry
+
+func (f byForms) Len() int { return len(f) }
+func (f byForms) Less(i, j int) bool {
+	if len(f[i].forms) != len(f[j].forms) {
+		return len(f[i].forms) > len(f[j].forms)
+	}
+	if f[i].refid != f[j].refid {
+		return f[i].refid < f[j].refid
+	}
+	return f[i].start < f[j].start
+}
+func (f byForms) Swap(i, j int) { f[i], f[j] = f[j], f[i] }
+
+// classPath returns the base name for per-class output files.
+func classPath(path, class string) string {
+	if class == "" {
+		return path
+	}
+	return fmt.Sprintf("%s-%s", path, strings.Replace(class, "/", "_", -1))
+}
+
+// pairPath returns the base name for per-pair output files.
+func pairPath(path string, i int) string {
+	if len(pairs) == 1 {
+		return path
+	}
+	return fmt.Sprintf("%s-%d", path, i+1)
+}
+
+func jointCSV(path string, data []set) error {
+	if len(data) == 0 {
+		return errors.New("no data")
+	}
+
+	f, err := os.Create(decorate(path, "joint.csv", filter))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if annot != "" {
+		_, err = fmt.Fprintln(f, "Class,Long,Short,FivePrime,ThreePrime,Count")
+	} else {
+		_, err = fmt.Fprintln(f, "Long,Short,FivePrime,ThreePrime,Count")
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range data {
+		for i, row := range e.joint {
+			for j, v := range row {
+				if v == 0 {
+					continue
+				}
+				_, err = fmt.Fprintf(f, "%s,%d,%d,%d\n", ident(e), i-maxLength, j-maxLength, v)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func jointJSON(path string, data []set) error {
+	if len(data) == 0 {
+		return errors.New("no data")
+	}
+
+	f, err := os.Create(decorate(path, "joint.json", filter))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	type jointPair struct {
+		Class string  `json:"class,omitempty"`
+		Long  string  `json:"long"`
+		Short string  `json:"short"`
+		Joint [][]int `json:"joint"`
+	}
+	type joint struct {
+		Filter int `json:"filter"`
+
+		// Offset is the offset of the first row
+		// and column of each joint matrix.
+		Offset int `json:"offset"`
+
+		Pairs []jointPair `json:"pairs"`
+	}
+	j := joint{Filter: filter, Offset: -maxLength}
+	for _, e := range data {
+		j.Pairs = append(j.Pairs, jointPair{Class: e.class, Long: e.long, Short: e.short, Joint: e.joint})
+	}
+
+	b, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	return err
+}
+
+// matrixCSV writes the offset distributions for each short and long length pair, and
+// grids of the mean offsets with short lengths in rows and long lengths in columns.
+func matrixCSV(path string, data []set) error {
+	if len(data) == 0 {
+		return errors.New("no data")
+	}
+
+	f, err := os.Create(decorate(path, "matrix.csv", filter))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if annot != "" {
+		_, err = fmt.Fprint(f, "End,Class,Long,Short,ShortLength,LongLength")
+	} else {
+		_, err = fmt.Fprint(f, "End,Long,Short,ShortLength,LongLength")
+	}
+	if err != nil {
+		return err
+	}
+	for i := 0; i < 2*maxLength; i++ {
+		_, err = fmt.Fprintf(f, ",%d", i-maxLength)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintln(f)
+	if err != nil {
+		return err
+	}
+
+	ends := [...]string{"FivePrime", "ThreePrime"}
+	for _, e := range data {
+		for s := shortMinLength; s <= shortMaxLength; s++ {
+			for l := s + 1; l <= longMaxLength; l++ {
+				m, ok := e.matrix[[2]int{s, l}]
+				if !ok {
+					continue
+				}
+				for j, end := range ends {
+					_, err = fmt.Fprintf(f, "%s,%s,%d,%d", end, ident(e), s, l)
+					if err != nil {
+						return err
+					}
+					for _, v := range m[j] {
+						_, err = fmt.Fprintf(f, ",%d", v)
+						if err != nil {
+							return err
+						}
+					}
+					_, err = fmt.Fprintln(f)
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+
+	g, err := os.Create(decorate(path, "matrix-mean.csv", filter))
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+
+	if annot != "" {
+		_, err = fmt.Fprint(g, "End,Class,Long,Short,ShortLength")
+	} else {
+		_, err = fmt.Fprint(g, "End,Long,Short,ShortLength")
+	}
+	if err != nil {
+		return err
+	}
+	for l := longMinLength; l <= longMaxLength; l++ {
+		_, err = fmt.Fprintf(g, ",%d", l)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintln(g)
+	if err != nil {
+		return err
+	}
+	for _, e := range data {
+		for j, end := range ends {
+			for s := shortMinLength; s <= shortMaxLength; s++ {
+				_, err = fmt.Fprintf(g, "Mean%s,%s,%d", end, ident(e), s)
+				if err != nil {
+					return err
+				}
+				for l := longMinLength; l <= longMaxLength; l++ {
+					m, ok := e.matrix[[2]int{s, l}]
+					if !ok {
+						_, err = fmt.Fprint(g, ",")
+					} else {
+						_, err = fmt.Fprintf(g, ",%.3f", mean(m[j]))
+					}
+					if err != nil {
+						return err
+					}
+				}
+				_, err = fmt.Fprintln(g)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// bootCI holds bootstrap percentile confidence intervals for a pair.
+type bootCI struct {
+	// fiveEnd and threeEnd hold the lower and upper
+	// bounds of the relative frequency of each offset.
+	fiveEnd  [][2]float64
+	threeEnd [][2]float64
+
+	// meanFive and meanThree hold the estimate and the
+	// lower and upper bounds of the mean offsets.
+	meanFive  [3]float64
+	meanThree [3]float64
+}
+
+// resample returns bootstrap confidence intervals at the given level for the offset
+// distributions of d, resampling the units of d b times.
+func resample(d set, b int, level float64, rnd *rand.Rand) *bootCI {
+	n := len(d.units)
+	if n == 0 {
+		return nil
+	}
+
+	var (
+		fiveFreq  = make([][]float64, len(d.fiveEnd))
+		threeFreq = make([][]float64, len(d.threeEnd))
+		fiveMean  = make([]float64, b)
+		threeMean = make([]float64, b)
+
+		five  = make([]int, len(d.fiveEnd))
+		three = make([]int, len(d.threeEnd))
+	)
+	for i := range fiveFreq {
+		fiveFreq[i] = make([]float64, b)
+		threeFreq[i] = make([]float64, b)
+	}
+	for k := 0; k < b; k++ {
+		for i := range five {
+			five[i] = 0
+			three[i] = 0
+		}
+		for j := 0; j < n; j++ {
+			for _, m := range d.units[rnd.Intn(n)] {
+				five[m[0]]++
+				three[m[1]]++
+			}
+		}
+		var total int
+		for _, v := range five {
+			total += v
+		}
+		for i := range five {
+			fiveFreq[i][k] = float64(five[i]) / float64(total)
+			threeFreq[i][k] = float64(three[i]) / float64(total)
+		}
+		fiveMean[k] = mean(five)
+		threeMean[k] = mean(three)
+	}
+
+	alpha := (1 - level) / 2
+	ci := &bootCI{
+		fiveEnd:  make([][2]float64, len(d.fiveEnd)),
+		threeEnd: make([][2]float64, len(d.threeEnd)),
+	}
+	for i := range fiveFreq {
+		ci.fiveEnd[i] = [2]float64{quantile(fiveFreq[i], alpha), quantile(fiveFreq[i], 1-alpha)}
+		ci.threeEnd[i] = [2]float64{quantile(threeFreq[i], alpha), quantile(threeFreq[i], 1-alpha)}
+	}
+	ci.meanFive = [3]float64{mean(d.fiveEnd), quantile(fiveMean, alpha), quantile(fiveMean, 1-alpha)}
+	ci.meanThree = [3]float64{mean(d.threeEnd), quantile(threeMean, alpha), quantile(threeMean, 1-alpha)}
+
+	return ci
+}
+
+// mean returns the mean offset of the offset counts in c.
+func mean(c []int) float64 {
+	var sum, n float64
+	for i, v := range c {
+		sum += float64((i - maxLength) * v)
+		n += float64(v)
+	}
+	return sum / n
+}
+
+// quantile returns the p quantile of x by linear interpolation. The
+// order of elements in x is altered.
+func quantile(x []float64, p float64) float64 {
+	sort.Float64s(x)
+	h := p * float64(len(x)-1)
+	i := int(h)
+	if i >= len(x)-1 {
+		return x[len(x)-1]
+	}
+	return x[i] + (h-float64(i))*(x[i+1]-x[i])
+}
+
+func bootstrapCSV(path string, data []set) error {
+	if len(data) == 0 {
+		return errors.New("no data")
+	}
+
+	f, err := os.Create(decorate(path, "bootstrap.csv", filter))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if annot != "" {
+		_, err = fmt.Fprintln(f, "Statistic,Class,Long,Short,Offset,Estimate,Lower,Upper")
+	} else {
+		_, err = fmt.Fprintln(f, "Statistic,Long,Short,Offset,Estimate,Lower,Upper")
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range data {
+		if e.ci == nil {
+			continue
+		}
+		for _, end := range []struct {
+			name   string
+			counts []int
+			ci     [][2]float64
+			mean   [3]float64
+		}{
+			{name: "FivePrime", counts: e.fiveEnd, ci: e.ci.fiveEnd, mean: e.ci.meanFive},
+			{name: "ThreePrime", counts: e.threeEnd, ci: e.ci.threeEnd, mean: e.ci.meanThree},
+		} {
+			var total int
+			for _, v := range end.counts {
+				total += v
+			}
+			for i, v := range end.counts {
+				_, err = fmt.Fprintf(f, "%s,%s,%d,%g,%g,%g\n", end.name, ident(e), i-maxLength,
+					float64(v)/float64(total), end.ci[i][0], end.ci[i][1])
+				if err != nil {
+					return err
+				}
+			}
+			_, err = fmt.Fprintf(f, "Mean%s,%s,,%g,%g,%g\n", end.name, ident(e), end.mean[0], end.mean[1], end.mean[2])
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// ciBars is a plotter that renders confidence intervals as vertical error
+// bars offset horizontally from nominal x positions.
+type ciBars struct {
+	ci     [][2]float64
+	offset vg.Length
+	draw.LineStyle
+}
+
+func (b *ciBars) Plot(c draw.Canvas, p *plot.Plot) {
+	trX, trY := p.Transforms(&c)
+	w := b.LineStyle.Width * 2
+	for i, v := range b.ci {
+		x := trX(float64(i)) + b.offset
+		lo, hi := trY(v[0]), trY(v[1])
+		c.StrokeLines(b.LineStyle,
+			[]draw.Point{{X: x, Y: lo}, {X: x, Y: hi}},
+			[]draw.Point{{X: x - w, Y: lo}, {X: x + w, Y: lo}},
+			[]draw.Point{{X: x - w, Y: hi}, {X: x + w, Y: hi}},
+		)
+	}
+}
+
+func (b *ciBars) DataRange() (xmin, xmax, ymin, ymax float64) {
+	ymin, ymax = math.Inf(1), math.Inf(-1)
+	for _, v := range b.ci {
+		ymin = math.Min(ymin, v[0])
+		ymax = math.Max(ymax, v[1])
+	}
+	return 0, float64(len(b.ci) - 1), ymin, ymax
+}
+
+// jointHeat is a plotter that renders a joint offset matrix as a heatmap with
+// log-scaled colour intensity.
+type jointHeat struct {
+	joint [][]int
+	max   float64
+}
+
+func newJointHeat(joint [][]int) *jointHeat {
+	h := &jointHeat{joint: joint}
+	for _, row := range joint {
+		for _, v := range row {
+			h.max = math.Max(h.max, float64(v))
+		}
+	}
+	return h
+}
+
+func (h *jointHeat) Plot(c draw.Canvas, p *plot.Plot) {
+	trX, trY := p.Transforms(&c)
+	for i, row := range h.joint {
+		for j, v := range row {
+			if v == 0 {
+				continue
+			}
+			x0, x1 := trX(float64(i-maxLength)-0.5), trX(float64(i-maxLength)+0.5)
+			y0, y1 := trY(float64(j-maxLength)-0.5), trY(float64(j-maxLength)+0.5)
+			c.FillPolygon(h.color(float64(v)), []draw.Point{
+				{X: x0, Y: y0}, {X: x1, Y: y0}, {X: x1, Y: y1}, {X: x0, Y: y1},
+			})
+		}
+	}
+}
+
+func (h *jointHeat) color(v float64) color.Color {
+	f := math.Log1p(v) / math.Log1p(h.max)
+	return color.RGBA{R: 0xff, G: uint8(0xff * (1 - f)), B: uint8(0xff * (1 - f)), A: 0xff}
+}
+
+func (h *jointHeat) DataRange() (xmin, xmax, ymin, ymax float64) {
+	xmin, ymin = math.Inf(1), math.Inf(1)
+	xmax, ymax = math.Inf(-1), math.Inf(-1)
+	for i, row := range h.joint {
+		for j, v := range row {
+			if v == 0 {
+				continue
+			}
+			xmin = math.Min(xmin, float64(i-maxLength)-0.5)
+			xmax = math.Max(xmax, float64(i-maxLength)+0.5)
+			ymin = math.Min(ymin, float64(j-maxLength)-0.5)
+			ymax = math.Max(ymax, float64(j-maxLength)+0.5)
+		}
+	}
+	if math.IsInf(xmin, 0) {
+		return -0.5, 0.5, -0.5, 0.5
+	}
+	return xmin, xmax, ymin, ymax
+}
+
+func heatmap(path string, data set) error {
+	font, err := vg.MakeFont("Helvetica", 10)
+	if err != nil {
+		return err
+	}
+	titleFont, err := vg.MakeFont("Helvetica", 12)
+	if err != nil {
+		return err
+	}
+	style := draw.TextStyle{Color: color.Gray{0}, Font: font}
+	p, err := plot.New()
+	if err != nil {
+		return err
+	}
+	h := newJointHeat(data.joint)
+	p.Title.Text = fmt.Sprintf("Joint end offsets - %s %s (max %d)", data.long, data.short, int(h.max))
+	if data.class != "" {
+		p.Title.Text = fmt.Sprintf("Joint end offsets - %s %s %s (max %d)", data.class, data.long, data.short, int(h.max))
+	}
+	p.Title.TextStyle = draw.TextStyle{Color: color.Gray{0}, Font: titleFont}
+	p.X.Label.Text = "5'-end Offset"
+	p.Y.Label.Text = "3'-end Offset"
+	p.X.Label.TextStyle = style
+	p.Y.Label.TextStyle = style
+	p.X.Tick.Label = style
+	p.Y.Tick.Label = style
+	p.Add(h)
+
+	return render(p, 15*vg.Centimeter, 15*vg.Centimeter, path, "joint", nil)
+}
+
+// render draws p to a canvas of the given size in the requested output format and
+// writes it to a file named for path and kind. If layout is not nil it is called
+// with the canvas after all plotters have been added and before p is drawn.
+func render(p *plot.Plot, width, height vg.Length, path, kind string, layout func(draw.Canvas)) error {
+	c, err := draw.NewFormattedCanvas(width, height, format)
+	if err != nil {
+		return err
+	}
+	dc := draw.New(c)
+	if layout != nil {
+		layout(dc)
+	}
+	p.Draw(dc)
+
+	f, err := os.Create(decorate(path, kind+"."+format, filter))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = c.WriteTo(f)
+
+	return err
+}
+
+// setRanges sets the user-specified axis ranges of the offset plot p.
+func setRanges(p *plot.Plot) {
+	if xMin != xMax {
+		p.X.Min = xMin + float64(maxLength)
+		p.X.Max = xMax + float64(maxLength)
+	}
+	if yMin != yMax {
+		p.Y.Min = yMin
+		p.Y.Max = yMax
+	}
+}
+
+// offsetTitle returns the title of an offset plot for the given class.
+func offsetTitle(class string) string {
+	t := titles[filter]
+	if title != "" {
+		t = title
+	}
+	if class != "" {
+		t += " - " + class
+	}
+	return t
+}
+
+type normalised struct {
+	vals []int
+	sum  float64
+}
+
+func (n *normalised) Len() int {
+	n.sum = 0
+	for _, v := range n.vals {
+		n.sum += float64(v)
+	}
+	return len(n.vals)
+}
+func (n *normalised) Value(i int) float64 { return float64(n.vals[i]) / n.sum }
+
+var titles = [...]string{
+	"Read end offsets - all small RNA",
+	"Read end offsets - primary piRNA",
+	"Read end offsets - secondary piRNA",
+}
 
 func barchart(path string, data set) error {
 	font, err := vg.MakeFont("Helvetica", 10)
@@ -574,13 +1815,13 @@ func barchart(path string, data set) error {
 	if err != nil {
 		return err
 	}
-	style := plot.TextStyle{Color: color.Gray{0}, Font: font}
+	style := draw.TextStyle{Color: color.Gray{0}, Font: font}
 	p, err := plot.New()
 	if err != nil {
 		return err
 	}
-	p.Title.Text = titles[filter]
-	p.Title.TextStyle = plot.TextStyle{Color: color.Gray{0}, Font: titleFont}
+	p.Title.Text = offsetTitle(data.class)
+	p.Title.TextStyle = draw.TextStyle{Color: color.Gray{0}, Font: titleFont}
 	p.X.Label.Text = "Length Offset"
 	p.Y.Label.Text = "Relative Frequency"
 	p.X.Label.TextStyle = style
@@ -617,26 +1858,29 @@ func barchart(path string, data set) error {
 		return n
 	}()...)
 
-	c := vgsvg.New(vg.Centimeters(19), vg.Centimeters(10))
-	da := plot.MakeDrawArea(c)
-	trX, _ := p.Transforms(&da)
-	w := ((trX(float64(2*maxLength)) - trX(float64(0))) / vg.Length(2*maxLength)) / 3
-
-	barsFivePrime.Width = w
-	barsFivePrime.Offset = -w / 2
-	barsThreePrime.Width = w
-	barsThreePrime.Offset = w / 2
+	var ciFivePrime, ciThreePrime *ciBars
+	if data.ci != nil {
+		ls := draw.LineStyle{Color: color.Gray{0}, Width: vg.Points(0.5)}
+		ciFivePrime = &ciBars{ci: data.ci.fiveEnd, LineStyle: ls}
+		ciThreePrime = &ciBars{ci: data.ci.threeEnd, LineStyle: ls}
+		p.Add(ciFivePrime, ciThreePrime)
+	}
 
-	p.Draw(da)
+	setRanges(p)
 
-	f, err := os.Create(decorate(path, "barchart.svg", filter))
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	_, err = c.WriteTo(f)
+	return render(p, 19*vg.Centimeter, 10*vg.Centimeter, path, "barchart", func(c draw.Canvas) {
+		trX, _ := p.Transforms(&c)
+		w := ((trX(float64(2*maxLength)) - trX(float64(0))) / vg.Length(2*maxLength)) / 3
 
-	return err
+		barsFivePrime.Width = w
+		barsFivePrime.Offset = -w / 2
+		barsThreePrime.Width = w
+		barsThreePrime.Offset = w / 2
+		if data.ci != nil {
+			ciFivePrime.offset = -w / 2
+			ciThreePrime.offset = w / 2
+		}
+	})
 }
 
 func boxplot(path string, sets []set) error {
@@ -673,13 +1917,13 @@ func boxplot(path string, sets []set) error {
 	if err != nil {
 		return err
 	}
-	style := plot.TextStyle{Color: color.Gray{0}, Font: font}
+	style := draw.TextStyle{Color: color.Gray{0}, Font: font}
 	p, err := plot.New()
 	if err != nil {
 		return err
 	}
-	p.Title.Text = titles[filter]
-	p.Title.TextStyle = plot.TextStyle{Color: color.Gray{0}, Font: titleFont}
+	p.Title.Text = offsetTitle(sets[0].class)
+	p.Title.TextStyle = draw.TextStyle{Color: color.Gray{0}, Font: titleFont}
 	p.X.Label.Text = "Length Offset"
 	p.Y.Label.Text = "Relative Frequency"
 	p.X.Label.TextStyle = style
@@ -736,26 +1980,17 @@ func boxplot(path string, sets []set) error {
 	p.X.Tick.Length = 8
 	p.Add(&plotter.Grid{Vertical: plotter.DefaultGridLineStyle})
 
-	c := vgsvg.New(vg.Centimeters(19), vg.Centimeters(10))
-	da := plot.MakeDrawArea(c)
-	trX, _ := p.Transforms(&da)
-	w := ((trX(float64(2*maxLength)) - trX(float64(0))) / vg.Length(2*maxLength)) / 3
-
-	for _, b := range boxes {
-		b.five.Width = w
-		b.five.Offset = -w / 2
-		b.three.Width = w
-		b.three.Offset = w / 2
-	}
+	setRanges(p)
 
-	p.Draw(da)
+	return render(p, 19*vg.Centimeter, 10*vg.Centimeter, path, "boxplot", func(c draw.Canvas) {
+		trX, _ := p.Transforms(&c)
+		w := ((trX(float64(2*maxLength)) - trX(float64(0))) / vg.Length(2*maxLength)) / 3
 
-	f, err := os.Create(decorate(path, "boxplot.svg", filter))
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	_, err = c.WriteTo(f)
-
-	return err
+		for _, b := range boxes {
+			b.five.Width = w
+			b.five.Offset = -w / 2
+			b.three.Width = w
+			b.three.Offset = w / 2
+		}
+	})
 }
@@ -0,0 +1,651 @@
+// Copyright ©2013 The bíogo Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// oxidation-ratio generates oxidation resistance ratios of small RNAs from a pair of NaIO4
+// treated (β-eliminated) and untreated libraries as a proxy for 3' 2'-O-methylation status.
+//
+// Small RNAs with an unmodified 3' terminal ribose are oxidised and β-eliminated by NaIO4
+// treatment and so are depleted from the treated library, while 2'-O-methylated small RNAs
+// are resistant. The ratio of normalised treated to untreated counts therefore estimates the
+// methylated fraction of a small RNA population.
+//
+// Approach
+//
+// BAM alignments from both libraries are read and filtered on sequence and mapping quality
+// and optionally on piRNA 1° or 2° status as in length-heat. Counts are collected for each
+// read sequence, for each alignment locus and for each genomic bin and read length.
+//
+// Library normalisation is either by the number of alignments passing the filters in each
+// library, or by the median treated to untreated ratio of sequences seen in both libraries,
+// which is robust to large scale loss of unmethylated small RNAs.
+//
+// Per sequence and per locus ratios are written as TSV and the per bin and read length ratios
+// are written as JSON in the format read by render-heat, with the number of distinct loci in
+// each bin as the support count. Bin and read length ratios with an untreated count below
+// -mincount are written as -1, which render-heat does not draw.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/biogo/biogo/feat"
+	"github.com/biogo/biogo/feat/genome/mouse/mm10"
+	"github.com/biogo/boom"
+)
+
+var (
+	in     pair
+	out    string
+	pretty bool
+
+	filter int
+	strict bool
+
+	norm     string
+	minCount int
+
+	binLength int
+	minLength int
+	maxLength int
+
+	minId  int
+	minQ   int
+	minAvQ float64
+	mapQ   int
+	mapQb  byte
+)
+
+const (
+	all = iota
+	primary
+	secondary
+)
+
+// Library indices.
+const (
+	oxidised = iota
+	untreated
+)
+
+type pair [2]string
+
+func (p *pair) String() string {
+	return fmt.Sprintf("%q,%q", p[0], p[1])
+}
+func (p *pair) Set(value string) error {
+	c := strings.Split(value, ",")
+	switch len(c) {
+	case 0:
+		return errors.New("empty pair")
+	case 2:
+		copy((*p)[:], c)
+		return nil
+	default:
+		return fmt.Errorf("unexpected number of elements: got %d expected 2", len(c))
+	}
+}
+
+func init() {
+	flag.Var(&in, "in", "comma separated pair of oxidised and untreated BAM files to be processed.")
+	flag.StringVar(&out, "out", "", "outfile base name.")
+	flag.BoolVar(&pretty, "pretty", true, "outfile JSON data indented.")
+	flag.StringVar(&norm, "norm", "total", "library normalisation: total - filtered alignment counts, median - median sequence ratio.")
+	flag.IntVar(&minCount, "mincount", 1, "minimum untreated count for a ratio to be calculated.")
+	flag.IntVar(&minLength, "min", 20, "minimum length read considered.")
+	flag.IntVar(&maxLength, "max", 35, "maximum length read considered.")
+	flag.IntVar(&minId, "minid", 90, "minimum percentage identity for non-clipped bases.")
+	flag.IntVar(&minQ, "minQ", 20, "minimum per-base sequence quality.")
+	flag.IntVar(&filter, "f", 0, "filter on piwi type 0: no filter, 1: primary, 2: secondary.")
+	flag.BoolVar(&strict, "strict", false, "filter rejects ambiguous reads.")
+	flag.Float64Var(&minAvQ, "minAvQ", 30, "minimum average per-base sequence quality.")
+	flag.IntVar(&mapQ, "mapQ", 0, "minimum mapping quality [0, 255).")
+	flag.IntVar(&binLength, "bin", 1e7, "bin length.")
+	help := flag.Bool("help", false, "output this usage message.")
+	flag.Parse()
+	mapQb = byte(mapQ)
+	if *help {
+		flag.Usage()
+		os.Exit(0)
+	}
+	if in[0] == "" || in[1] == "" || out == "" || minCount < 1 || mapQ < 0 || mapQ > 254 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	switch norm {
+	case "total", "median":
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+}
+
+func qualOk(r *boom.Record, minId, minQ int, minAvQ float64) (ok bool) {
+	var (
+		off, l int
+		match  int
+		mQ     int
+		edit   int
+	)
+
+	for _, t := range r.Tags() {
+		if t.Tag() == [2]byte{'N', 'M'} {
+			switch e := t.Value().(type) {
+			case byte:
+				edit = int(e)
+			case uint16:
+				edit = int(e)
+			case uint32:
+				edit = int(e)
+			default:
+				edit = 0
+			}
+		}
+	}
+	cigar := r.Cigar()
+	qual := r.Quality()
+	for _, c := range cigar {
+		t := c.Type()
+		if t == boom.CigarMatch || t == boom.CigarInsertion || t == boom.CigarSoftClipped || t == boom.CigarEqual || t == boom.CigarMismatch {
+			off = l
+			l += c.Len()
+			for _, q := range qual[off:l] {
+				if int(q) < minQ {
+					return false
+				}
+				if t == boom.CigarMatch || t == boom.CigarEqual || t == boom.CigarSoftClipped {
+					if t != boom.CigarSoftClipped {
+						match++
+					}
+					mQ += int(q)
+				}
+			}
+		}
+	}
+	match -= edit
+
+	return match*100 >= minId*l && mQ >= int(minAvQ*float64(l))
+}
+
+var index = map[string]int{}
+
+func init() {
+	for i, c := range mm10.Chromosomes {
+		index[strings.ToLower(c.Chr)] = i
+	}
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func isPrimary(r *boom.Record) bool {
+	seq := r.Seq()
+	if len(seq) < 1 {
+		return false
+	}
+	if r.Flags()&boom.Reverse == 0 {
+		return seq[0]|' ' == 't'
+	}
+	return seq[len(seq)-1]|' ' == 'a'
+}
+
+func isSecondary(r *boom.Record) bool {
+	seq := r.Seq()
+	if len(seq) < 10 {
+		return false
+	}
+	if r.Flags()&boom.Reverse == 0 {
+		return seq[9]|' ' == 'a'
+	}
+	return seq[len(seq)-10]|' ' == 't'
+}
+
+// locus is a stranded alignment interval.
+type locus struct {
+	refid, start, end int
+	reverse           bool
+}
+
+// location is a genomic bin.
+type location struct {
+	rid int
+	pos int
+}
+
+// bin holds the per read length counts of a genomic bin for each library
+// and the set of loci seen in the bin.
+type bin struct {
+	reads [2]map[int]int
+	loci  map[locus]struct{}
+}
+
+// tallies holds the counts for each library.
+type tallies struct {
+	total [2]int
+	seqs  map[string]*[2]int
+	loci  map[locus]*[2]int
+	bins  map[location]*bin
+}
+
+var complement = [256]byte{'a': 't', 'c': 'g', 'g': 'c', 't': 'a', 'n': 'n'}
+
+// readSeq returns the lower case sequence of r in read orientation.
+func readSeq(r *boom.Record) string {
+	s := r.Seq()
+	b := make([]byte, len(s))
+	if r.Flags()&boom.Reverse == 0 {
+		for i, c := range s {
+			b[i] = c | ' '
+		}
+	} else {
+		for i, c := range s {
+			b[len(b)-1-i] = complement[c|' ']
+		}
+	}
+	return string(b)
+}
+
+// count adds the alignments in the BAM file in to the lib counts of t and returns
+// the reference names of the file.
+func count(in string, lib int, t *tallies) ([]string, error) {
+	fmt.Fprintf(os.Stderr, "Reading %q\n", in)
+	bf, err := boom.OpenBAM(in)
+	if err != nil {
+		return nil, err
+	}
+	defer bf.Close()
+
+loop:
+	for {
+		r, _, err := bf.Read()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		if r.Flags()&boom.Unmapped != 0 || !qualOk(r, minId, minQ, minAvQ) {
+			continue
+		}
+		l := len(r.Seq())
+		if s := r.Score(); s < mapQb || s == 0xff || l < minLength || maxLength < l {
+			continue
+		}
+		switch filter {
+		case all:
+		case primary:
+			if !isPrimary(r) {
+				continue loop
+			}
+			if strict && isSecondary(r) {
+				continue loop
+			}
+		case secondary:
+			if !isSecondary(r) {
+				continue loop
+			}
+			if strict && isPrimary(r) {
+				continue loop
+			}
+		default:
+			panic("illegal filter value")
+		}
+
+		t.total[lib]++
+
+		seq := readSeq(r)
+		sc, ok := t.seqs[seq]
+		if !ok {
+			sc = &[2]int{}
+			t.seqs[seq] = sc
+		}
+		sc[lib]++
+
+		lo := locus{refid: r.RefID(), start: r.Start(), end: r.Start() + l, reverse: r.Flags()&boom.Reverse != 0}
+		lc, ok := t.loci[lo]
+		if !ok {
+			lc = &[2]int{}
+			t.loci[lo] = lc
+		}
+		lc[lib]++
+
+		loc := location{rid: r.RefID(), pos: r.Start() / binLength}
+		b, ok := t.bins[loc]
+		if !ok {
+			b = &bin{
+				reads: [2]map[int]int{make(map[int]int), make(map[int]int)},
+				loci:  make(map[locus]struct{}),
+			}
+			t.bins[loc] = b
+		}
+		b.reads[lib][l]++
+		b.loci[lo] = struct{}{}
+	}
+
+	return bf.RefNames(), nil
+}
+
+// scale returns the factor s such that s*ox/untreated is the normalised oxidation ratio.
+func (t *tallies) scale() (float64, error) {
+	switch norm {
+	case "total":
+		if t.total[oxidised] == 0 {
+			return 0, errors.New("no oxidised alignments")
+		}
+		return float64(t.total[untreated]) / float64(t.total[oxidised]), nil
+	case "median":
+		var r []float64
+		for _, c := range t.seqs {
+			if c[oxidised] != 0 && c[untreated] != 0 {
+				r = append(r, float64(c[oxidised])/float64(c[untreated]))
+			}
+		}
+		if len(r) == 0 {
+			return 0, errors.New("no sequences shared between libraries")
+		}
+		sort.Float64s(r)
+		m := r[len(r)/2]
+		if len(r)%2 == 0 {
+			m = (m + r[len(r)/2-1]) / 2
+		}
+		return 1 / m, nil
+	default:
+		panic("illegal normalisation")
+	}
+}
+
+// missing is the JSON score of a bin and read length with no ratio.
+const missing = -1
+
+// ratio returns the normalised oxidation ratio of c and whether the untreated
+// count reaches minCount.
+func ratio(c [2]int, s float64) (float64, bool) {
+	if c[untreated] < minCount {
+		return 0, false
+	}
+	return s * float64(c[oxidised]) / float64(c[untreated]), true
+}
+
+func main() {
+	t := &tallies{
+		seqs: make(map[string]*[2]int),
+		loci: make(map[locus]*[2]int),
+		bins: make(map[location]*bin),
+	}
+	var names []string
+	for lib, f := range in {
+		n, err := count(f, lib, t)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if names != nil {
+			if len(names) != len(n) {
+				fmt.Fprintln(os.Stderr, "header mismatch")
+				os.Exit(1)
+			}
+			for i := range n {
+				if names[i] != n[i] {
+					fmt.Fprintln(os.Stderr, "header mismatch")
+					os.Exit(1)
+				}
+			}
+		}
+		names = n
+	}
+
+	s, err := t.scale()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "normalisation scale: %g\n", s)
+
+	err = writeSequences(decorate(out, "sequences.tsv", filter), t, s)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	err = writeLoci(decorate(out, "loci.tsv", filter), t, names, s)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	var rna []*feature
+	for k, v := range t.bins {
+		i, ok := index[strings.ToLower(names[k.rid])]
+		if !ok {
+			continue
+		}
+		c := mm10.Chromosomes[i]
+		f := &feature{
+			start:    k.pos * binLength,
+			end:      min((k.pos+1)*binLength, c.Len()),
+			chr:      c,
+			scores:   make([]float64, maxLength-minLength+1),
+			supports: len(v.loci),
+		}
+		for l := minLength; l <= maxLength; l++ {
+			r, ok := ratio([2]int{v.reads[oxidised][l], v.reads[untreated][l]}, s)
+			if !ok {
+				r = missing
+			}
+			f.scores[l-minLength] = r
+		}
+		rna = append(rna, f)
+	}
+
+	err = writeJSON(out, rna, filter, pretty)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func decorate(out, format string, filter int) string {
+	switch filter {
+	case all:
+		return fmt.Sprintf("%s.%s", out, format)
+	case primary:
+		return fmt.Sprintf("%s-U1.%s", out, format)
+	case secondary:
+		return fmt.Sprintf("%s-A10.%s", out, format)
+	default:
+		panic("illegal filter")
+	}
+}
+
+func writeSequences(path string, t *tallies, s float64) error {
+	seqs := make([]string, 0, len(t.seqs))
+	for seq := range t.seqs {
+		seqs = append(seqs, seq)
+	}
+	sort.Strings(seqs)
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	_, err = fmt.Fprintln(w, "sequence\tlength\toxidised\tuntreated\tratio")
+	if err != nil {
+		f.Close()
+		return err
+	}
+	for _, seq := range seqs {
+		c := *t.seqs[seq]
+		r, ok := ratio(c, s)
+		if !ok {
+			continue
+		}
+		_, err = fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%g\n", seq, len(seq), c[oxidised], c[untreated], r)
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	err = w.Flush()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+type byLocus []locus
+
+func (l byLocus) Len() int { return len(l) }
+func (l byLocus) Less(i, j int) bool {
+	a, b := l[i], l[j]
+	switch {
+	case a.refid != b.refid:
+		return a.refid < b.refid
+	case a.start != b.start:
+		return a.start < b.start
+	case a.end != b.end:
+		return a.end < b.end
+	}
+	return !a.reverse && b.reverse
+}
+func (l byLocus) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+
+func writeLoci(path string, t *tallies, names []string, s float64) error {
+	loci := make([]locus, 0, len(t.loci))
+	for l := range t.loci {
+		loci = append(loci, l)
+	}
+	sort.Sort(byLocus(loci))
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	_, err = fmt.Fprintln(w, "chrom\tstart\tend\tstrand\toxidised\tuntreated\tratio")
+	if err != nil {
+		f.Close()
+		return err
+	}
+	for _, l := range loci {
+		c := *t.loci[l]
+		r, ok := ratio(c, s)
+		if !ok {
+			continue
+		}
+		strand := "+"
+		if l.reverse {
+			strand = "-"
+		}
+		_, err = fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%d\t%d\t%g\n", names[l.refid], l.start, l.end, strand, c[oxidised], c[untreated], r)
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	err = w.Flush()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func writeJSON(out string, rna []*feature, filter int, pretty bool) error {
+	jsf, err := os.Create(decorate(out, "json", filter))
+	if err != nil {
+		return err
+	}
+	defer jsf.Close()
+
+	type ranged struct {
+		Sample string `json:"sample"`
+
+		Bin    int `json:"bin"`
+		Filter int `json:"filter"`
+
+		Min int `json:"min"`
+		Max int `json:"max"`
+
+		MinQ   int     `json:"min-qual"`
+		MinAvQ float64 `json:"min-av-qual"`
+		MinID  int     `json:"min-id"`
+		MapQ   int     `json:"map-qual"`
+
+		Features []*feature `json:"features"`
+	}
+
+	r := ranged{
+		Sample:   fmt.Sprintf("%s/%s", path(in[oxidised]), path(in[untreated])),
+		Bin:      binLength,
+		Filter:   filter,
+		Min:      minLength,
+		Max:      maxLength,
+		MinQ:     minQ,
+		MinAvQ:   minAvQ,
+		MinID:    minId,
+		MapQ:     mapQ,
+		Features: rna,
+	}
+
+	if pretty {
+		j, err := json.MarshalIndent(r, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = jsf.Write(j)
+		if err != nil {
+			return err
+		}
+	} else {
+		enc := json.NewEncoder(jsf)
+		err = enc.Encode(r)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func path(p string) string {
+	p, _ = filepath.Abs(p)
+	return p
+}
+
+type feature struct {
+	start, end int
+	name       string
+	chr        feat.Feature
+	scores     []float64
+	supports   int
+}
+
+func (f *feature) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Chr      string    `json:"chr"`
+		Start    int       `json:"start"`
+		End      int       `json:"end"`
+		Scores   []float64 `json:"scores"`
+		Supports int       `json:"support"`
+	}{
+		Chr:      f.chr.Name(),
+		Start:    f.start,
+		End:      f.end,
+		Scores:   f.scores,
+		Supports: f.supports,
+	})
+}
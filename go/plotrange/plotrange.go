@@ -2,47 +2,181 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
+// plotrange calculates shared heat, trace and count ranges for a set of length-heat or
+// length-heat-annot-diff json files.
+//
+// The ranges are printed and optionally written to a scale manifest that can be given to
+// render-heat and render-diff with the -scale flag so that multi-panel figures share a
+// consistent scale. Ranges may be calculated from robust quantiles rather than the extremes
+// of the data.
 package main
 
 import (
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"math"
 	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/biogo/rnaseq/norm"
+)
+
+var (
+	out string
+
+	normalisation int
+	quantile      float64
+
+	pretty bool
 )
 
+func init() {
+	flag.StringVar(&out, "out", "", "file name of the scale manifest to write.")
+	flag.IntVar(&normalisation, "normalise", 0, "normalisation strategy for diff json: 0 - lib size, 1 - per bin, 2 - per bin/size.")
+	flag.Float64Var(&quantile, "quantile", 0, "use the [q, 1-q] quantile range of values rather than the extremes.")
+	flag.BoolVar(&pretty, "pretty", true, "outfile JSON data indented.")
+	help := flag.Bool("help", false, "output this usage message.")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] <json files>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *help {
+		flag.Usage()
+		os.Exit(0)
+	}
+	if flag.NArg() == 0 || quantile < 0 || quantile >= 0.5 {
+		flag.Usage()
+		os.Exit(1)
+	}
+}
+
+const (
+	heatKind = "heat"
+	diffKind = "diff"
+)
+
+// Scale is a shared set of ranges for rendering a collection of json files.
+type Scale struct {
+	Files     []string `json:"files"`
+	Kind      string   `json:"kind"`
+	Normalise int      `json:"normalise"`
+	Quantile  float64  `json:"quantile"`
+
+	Heat   [2]float64 `json:"heat"`
+	Trace  [2]float64 `json:"trace"`
+	Counts [2]float64 `json:"counts"`
+}
+
+// values holds the accumulated values for each track.
+type values struct {
+	heat, trace, counts []float64
+}
+
 func main() {
-	fmt.Println(os.Args[1:])
+	fmt.Println(flag.Args())
+
 	var (
-		minTrace,
-		maxTrace float64
-		maxCount int
+		v    values
+		kind string
 	)
-	for i, in := range os.Args[1:] {
-		mint, maxt, maxc, err := readJSON(in)
+	for _, in := range flag.Args() {
+		k, err := readJSON(in, &v)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", err, in)
+			os.Exit(1)
+		}
+		if kind != "" && k != kind {
+			fmt.Fprintf(os.Stderr, "mixed json kinds: %s\n", in)
+			os.Exit(1)
+		}
+		kind = k
+	}
+
+	s := Scale{
+		Kind:      kind,
+		Normalise: normalisation,
+		Quantile:  quantile,
+		Heat:      rangeOf(v.heat, quantile),
+		Trace:     rangeOf(v.trace, quantile),
+		Counts:    rangeOf(v.counts, quantile),
+	}
+	for _, in := range flag.Args() {
+		p, _ := filepath.Abs(in)
+		s.Files = append(s.Files, p)
+	}
+
+	fmt.Printf("Heat minimum: %f\nHeat maximum: %f\n", s.Heat[0], s.Heat[1])
+	fmt.Printf("Trace minimum: %f\nTrace maximum: %f\n", s.Trace[0], s.Trace[1])
+	fmt.Printf("Count minimum: %f\nCount maximum: %f\n", s.Counts[0], s.Counts[1])
+
+	if out != "" {
+		err := writeJSON(out, s, pretty)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
-		if i == 0 {
-			minTrace = mint
-			maxTrace = maxt
-			maxCount = maxc
-			continue
+	}
+}
+
+// rangeOf returns the [q, 1-q] quantile range of the non-NaN values in v.
+func rangeOf(v []float64, q float64) [2]float64 {
+	f := v[:0:0]
+	for _, x := range v {
+		if !math.IsNaN(x) && !math.IsInf(x, 0) {
+			f = append(f, x)
 		}
-		minTrace = math.Min(minTrace, mint)
-		maxTrace = math.Max(maxTrace, maxt)
-		maxCount = max(maxCount, maxc)
 	}
-	fmt.Printf("Trace minimum: %f\nTrace maximum: %f\nCount maximum: %d\n", minTrace, maxTrace, maxCount)
+	if len(f) == 0 {
+		return [2]float64{math.NaN(), math.NaN()}
+	}
+	sort.Float64s(f)
+	if q == 0 {
+		return [2]float64{f[0], f[len(f)-1]}
+	}
+	return [2]float64{quantileOf(f, q), quantileOf(f, 1-q)}
 }
 
-func max(a, b int) int {
-	if a > b {
-		return a
+// quantileOf returns the q quantile of the sorted values in f by linear interpolation.
+func quantileOf(f []float64, q float64) float64 {
+	pos := q * float64(len(f)-1)
+	i := int(pos)
+	if i+1 >= len(f) {
+		return f[len(f)-1]
 	}
-	return b
+	frac := pos - float64(i)
+	return f[i]*(1-frac) + f[i+1]*frac
+}
+
+func writeJSON(out string, s Scale, pretty bool) error {
+	jsf, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer jsf.Close()
+
+	// NaN values are not valid JSON, so replace them with zero which renderers
+	// interpret as unset.
+	for _, r := range []*[2]float64{&s.Heat, &s.Trace, &s.Counts} {
+		for i, v := range r {
+			if math.IsNaN(v) {
+				r[i] = 0
+			}
+		}
+	}
+
+	if pretty {
+		j, err := json.MarshalIndent(s, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = jsf.Write(j)
+		return err
+	}
+	return json.NewEncoder(jsf).Encode(s)
 }
 
 const (
@@ -65,85 +199,131 @@ func scores(fs []float64, minLength int) (short, long float64) {
 	return math.NaN(), math.NaN()
 }
 
-func readJSON(in string) (minTrace, maxTrace float64, maxCounts int, err error) {
+func readJSON(in string, v *values) (kind string, err error) {
 	jsf, err := os.Open(in)
 	if err != nil {
-		return math.NaN(), math.NaN(), 0, err
+		return "", err
 	}
 	defer jsf.Close()
 
 	type rangedJSONFeatures struct {
-		Min      int               `json:"min"`
-		Max      int               `json:"max"`
+		Sample string    `json:"sample"`
+		Pair   [2]string `json:"pair"`
+
+		Bin int `json:"bin"`
+		Min int `json:"min"`
+		Max int `json:"max"`
+
+		Totals   [2]int            `json:"totals"`
 		Features []json.RawMessage `json:"features"`
 	}
-	var v rangedJSONFeatures
+	var r rangedJSONFeatures
 
-	err = json.NewDecoder(jsf).Decode(&v)
+	err = json.NewDecoder(jsf).Decode(&r)
 	if err != nil {
-		return math.NaN(), math.NaN(), 0, err
+		return "", err
 	}
-	if len(v.Features) == 0 {
-		return math.NaN(), math.NaN(), 0, errors.New("no feature")
+	if len(r.Features) == 0 {
+		return "", errors.New("no feature")
 	}
 
 	type (
 		jsonFeature struct {
+			Start    int       `json:"start"`
+			End      int       `json:"end"`
 			Scores   []float64 `json:"scores"`
 			Supports int       `json:"support"`
 		}
 		jsonFeature2 struct {
-			Scores   []float64 `json:"scores"`
-			Supports [2]int    `json:"support"`
+			Start    int          `json:"start"`
+			End      int          `json:"end"`
+			Counts   [2][]float64 `json:"counts"`
+			Supports [2]int       `json:"support"`
 		}
 	)
 
-	var (
-		v1 = &jsonFeature{}
-		v2 = &jsonFeature2{}
+	if r.Sample != "" {
+		for _, f := range r.Features {
+			var jf jsonFeature
+			err = json.Unmarshal(f, &jf)
+			if err != nil {
+				return "", err
+			}
+			// Negative scores mark missing values, as
+			// in render-heat, and are excluded from the
+			// ranges as NaN.
+			for i, s := range jf.Scores {
+				if s < 0 {
+					jf.Scores[i] = math.NaN()
+				}
+			}
+			v.heat = append(v.heat, jf.Scores...)
+			sh, lo := scores(jf.Scores, r.Min)
+			v.trace = append(v.trace, sh, lo)
+			factor := float64(r.Bin) / float64(jf.End-jf.Start)
+			v.counts = append(v.counts, float64(jf.Supports)*factor)
+		}
+		return heatKind, nil
+	}
 
-		t interface{}
-	)
-	if err = json.Unmarshal(v.Features[0], v1); err == nil {
-		t = &jsonFeature{}
-		maxCounts = v1.Supports
-		maxTrace = math.Max(scores(v1.Scores, v.Min))
-	} else if err = json.Unmarshal(v.Features[0], v2); err == nil {
-		t = &jsonFeature2{}
-		maxCounts = max(v2.Supports[0], v2.Supports[1])
-		sh, lo := scores(v2.Scores, v.Min)
-		minTrace = math.Min(sh, lo)
-		maxTrace = math.Max(sh, lo)
-	} else {
-		return math.NaN(), math.NaN(), 0, err
-	}
-
-	for _, f := range v.Features {
-		err = json.Unmarshal(f, t)
+	fs := make([]jsonFeature2, len(r.Features))
+	for i, f := range r.Features {
+		err = json.Unmarshal(f, &fs[i])
 		if err != nil {
-			return math.NaN(), math.NaN(), 0, err
+			return "", err
 		}
-		switch t := t.(type) {
-		case *jsonFeature:
-			maxCounts = max(maxCounts, t.Supports)
-			m := math.Max(scores(t.Scores, v.Min))
-			if math.IsNaN(m) {
-				break
-			}
-			maxTrace = math.Max(maxTrace, m)
-		case *jsonFeature2:
-			maxCounts = max(maxCounts, max(t.Supports[0], t.Supports[1]))
-			sh, lo := scores(t.Scores, v.Min)
-			min := math.Min(sh, lo)
-			max := math.Max(sh, lo)
-			if !math.IsNaN(min) {
-				minTrace = math.Min(minTrace, min)
+	}
+	var weights [2]float64
+	switch normalisation {
+	case 0:
+		weights[0], weights[1] = float64(r.Totals[0]), float64(r.Totals[1])
+	case 1:
+		var data [2][]float64
+		for _, f := range fs {
+			for i := range data {
+				data[i] = append(data[i], sum(f.Counts[i]))
 			}
-			if !math.IsNaN(max) {
-				maxTrace = math.Max(maxTrace, max)
+		}
+		weights, err = tmm(data)
+	case 2:
+		var data [2][]float64
+		for _, f := range fs {
+			for i := range data {
+				data[i] = append(data[i], f.Counts[i]...)
 			}
 		}
+		weights, err = tmm(data)
+	default:
+		err = errors.New("illegal normalisation strategy")
 	}
+	if err != nil {
+		return "", err
+	}
+	for _, f := range fs {
+		diff := make([]float64, len(f.Counts[0]))
+		for i := range diff {
+			diff[i] = f.Counts[1][i]/weights[1] - f.Counts[0][i]/weights[0]
+		}
+		v.heat = append(v.heat, diff...)
+		sh, lo := scores(diff, r.Min)
+		v.trace = append(v.trace, sh, lo)
+		factor := float64(r.Bin) / float64(f.End-f.Start)
+		v.counts = append(v.counts, float64(f.Supports[0])*factor, float64(f.Supports[1])*factor)
+	}
+	return diffKind, nil
+}
+
+func sum(f []float64) float64 {
+	var s float64
+	for _, v := range f {
+		s += v
+	}
+	return s
+}
 
-	return minTrace, maxTrace, maxCounts, nil
+func tmm(data [2][]float64) ([2]float64, error) {
+	var factors [2]float64
+	f, err := norm.TMM(data[:], -1, 0.3, 0.05, -1e10, true)
+	copy(factors[:], f)
+	return factors, err
 }
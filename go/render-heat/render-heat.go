@@ -34,6 +34,11 @@ var (
 
 	minLength, maxLength, binLength int
 
+	scale string
+
+	minHeat   float64
+	maxHeat   float64
+	minTrace  float64
 	maxTrace  float64
 	maxCounts float64
 
@@ -68,6 +73,8 @@ func init() {
 	flag.StringVar(&format, "format", "svg", "specifies the output format of the example: eps, jpg, jpeg, pdf, png, svg, and tiff.")
 	flag.Var(&highlight, "highlight", "comma separated set of chromosome names to highlight.")
 	flag.StringVar(&palname, "palette", "Set1", "specify the palette name for highlighting.")
+	flag.StringVar(&scale, "scale", "", "file name of a plotrange scale manifest; explicit range flags take precedence.")
+	flag.Float64Var(&minTrace, "tracemin", 0, "set the minimum value for the outer trace if not zero.")
 	flag.Float64Var(&maxTrace, "tracemax", 0, "set the maximum value for the outer trace if not zero.")
 	flag.Float64Var(&maxCounts, "countmax", 0, "set the maximum value for the inner trace if not zero.")
 	help := flag.Bool("help", false, "output this usage message.")
@@ -80,6 +87,27 @@ func init() {
 		flag.Usage()
 		os.Exit(1)
 	}
+	if scale != "" {
+		s, err := readScale(scale)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if s.Kind != "heat" {
+			fmt.Fprintf(os.Stderr, "scale manifest is not for heat json: %s\n", s.Kind)
+			os.Exit(1)
+		}
+		minHeat, maxHeat = s.Heat[0], s.Heat[1]
+		if minTrace == 0 {
+			minTrace = s.Trace[0]
+		}
+		if maxTrace == 0 {
+			maxTrace = s.Trace[1]
+		}
+		if maxCounts == 0 {
+			maxCounts = s.Counts[1]
+		}
+	}
 	for _, s := range []string{"eps", "jpg", "jpeg", "pdf", "png", "svg", "tiff"} {
 		if format == s {
 			return
@@ -159,6 +187,28 @@ heat range: [%f,%f]`,
 	}
 }
 
+// scaleManifest is the shared scale written by plotrange.
+type scaleManifest struct {
+	Kind   string     `json:"kind"`
+	Heat   [2]float64 `json:"heat"`
+	Trace  [2]float64 `json:"trace"`
+	Counts [2]float64 `json:"counts"`
+}
+
+func readScale(in string) (*scaleManifest, error) {
+	f, err := os.Open(in)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var s scaleManifest
+	err = json.NewDecoder(f).Decode(&s)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
 func decorate(out, format string, filter int) string {
 	switch filter {
 	case all:
@@ -269,6 +319,14 @@ func (f *feature) UnmarshalJSON(b []byte) error {
 	if err != nil {
 		return err
 	}
+	// Negative scores mark missing values,
+	// for example oxidation-ratio bins with
+	// too few untreated reads.
+	for i, v := range jf.Scores {
+		if v < 0 {
+			jf.Scores[i] = math.NaN()
+		}
+	}
 	*f = feature{
 		chr:      mm10.Chromosomes[index[strings.ToLower(jf.Chr)]],
 		start:    jf.Start,
@@ -428,6 +486,9 @@ func mouseTracks(scores []rings.Scorer, highlight []string, palname string, diam
 	if err != nil {
 		return nil, 0, 0, err
 	}
+	if minHeat != maxHeat {
+		s.Min, s.Max = minHeat, maxHeat
+	}
 	p = append(p, s)
 
 	smallFont, err := vg.MakeFont("Helvetica", radius*small)
@@ -467,6 +528,9 @@ func mouseTracks(scores []rings.Scorer, highlight []string, palname string, diam
 	if err != nil {
 		return nil, 0, 0, err
 	}
+	if minTrace != 0 {
+		t.Min = minTrace
+	}
 	if maxTrace != 0 {
 		t.Max = maxTrace
 		if t.Min > t.Max {
@@ -0,0 +1,602 @@
+// Copyright ©2013 The bíogo Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// render-ma renders MA and volcano plots of piRNA expression level differences described
+// by the json output of length-heat-annot-diff.
+//
+// Points may be genomic bins, summing over all read lengths, or individual bin and read
+// length classes. Expression values are normalised using the same strategies as render-diff,
+// with TMM factors applied to the library sizes, and points are coloured by chromosome, by
+// the annotation classes of the input file or by read length.
+//
+// Significance for the volcano plot is estimated with a conditional binomial test on the
+// raw counts of each point, with the expected proportion given by the effective library
+// sizes. P-values are adjusted over all points with the Benjamini-Hochberg procedure before
+// plotting and labelling.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image/color"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/biogo/biogo/feat/genome"
+	"github.com/biogo/biogo/feat/genome/mouse/mm10"
+	"github.com/biogo/rnaseq/norm"
+
+	"github.com/gonum/plot"
+	"github.com/gonum/plot/palette"
+	"github.com/gonum/plot/palette/brewer"
+	"github.com/gonum/plot/plotter"
+	"github.com/gonum/plot/vg"
+	"github.com/gonum/plot/vg/draw"
+)
+
+var (
+	in     set
+	out    string
+	format string
+
+	normalisation int
+
+	unit    string
+	colour  string
+	palname string
+
+	labels int
+)
+
+const (
+	all = iota
+	primary
+	secondary
+)
+
+type set []string
+
+func (s *set) String() string {
+	if len(*s) == 0 {
+		return `""`
+	}
+	return strings.Join(*s, ",")
+}
+func (s *set) Set(value string) error {
+	*s = append(*s, strings.Split(value, ",")...)
+	if len(*s) == 0 {
+		return errors.New("empty set")
+	}
+	return nil
+}
+
+func init() {
+	flag.Var(&in, "in", "comma separated set of json files to be rendered (may be invoked multiple times).")
+	flag.StringVar(&out, "out", "", "base name for output files (default derived from the first input).")
+	flag.StringVar(&format, "format", "svg", "specifies the output format of the figure: eps, jpg, jpeg, pdf, png, svg, and tiff.")
+	flag.IntVar(&normalisation, "normalise", 0, "normalisation strategy: 0 - lib size, 1 - per bin, 2 - per bin/size.")
+	flag.StringVar(&unit, "unit", "bin", "point unit: bin - genomic bin, length - genomic bin and read length.")
+	flag.StringVar(&colour, "colour", "chr", "colour points by: chr - chromosome, class - annotation class, length - read length.")
+	flag.StringVar(&palname, "palette", "Paired", "specify the qualitative palette name for point colours.")
+	flag.IntVar(&labels, "label", 10, "number of most significant points to label.")
+	help := flag.Bool("help", false, "output this usage message.")
+	flag.Parse()
+	if *help {
+		flag.Usage()
+		os.Exit(0)
+	}
+	if len(in) == 0 || labels < 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	switch unit {
+	case "bin", "length":
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+	switch colour {
+	case "chr", "class", "length":
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+	if colour == "length" && unit != "length" {
+		fmt.Fprintln(os.Stderr, "colour by length requires -unit length")
+		os.Exit(1)
+	}
+	for _, s := range []string{"eps", "jpg", "jpeg", "pdf", "png", "svg", "tiff"} {
+		if format == s {
+			return
+		}
+	}
+	flag.Usage()
+	os.Exit(1)
+}
+
+var index = map[string]int{}
+
+func init() {
+	for i, c := range mm10.Chromosomes {
+		index[strings.ToLower(c.Chr)] = i
+	}
+}
+
+func main() {
+	var (
+		points []point
+		first  *Ranged
+	)
+	for _, f := range in {
+		rna, err := readJSON(f)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if first == nil {
+			first = rna
+		} else if rna.Filter != first.Filter || rna.Min != first.Min || rna.Max != first.Max {
+			fmt.Fprintf(os.Stderr, "incompatible input: %s\n", f)
+			os.Exit(1)
+		}
+
+		var weights [2]float64
+		switch normalisation {
+		case 0:
+			weights[0], weights[1] = float64(rna.Totals[0]), float64(rna.Totals[1])
+		case 1:
+			weights, err = normaliseByBin(rna)
+		case 2:
+			weights, err = normaliseByBlock(rna)
+		default:
+			err = errors.New("illegal normalisation strategy")
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if normalisation != 0 {
+			// TMM factors are relative, so scale
+			// the library sizes to give effective
+			// library sizes.
+			for i := range weights {
+				weights[i] *= float64(rna.Totals[i])
+			}
+		}
+
+		points = append(points, pointsOf(rna, weights)...)
+	}
+	if len(points) == 0 {
+		fmt.Fprintln(os.Stderr, "no data")
+		os.Exit(1)
+	}
+	adjust(points)
+
+	if out == "" {
+		n := filepath.Base(first.Pair[1])
+		out = n[:strings.Index(n, filepath.Ext(n))]
+		var classes []string
+		for _, class := range first.Classes {
+			classes = append(classes, class[strings.LastIndex(class, "/")+1:])
+		}
+		if len(classes) > 0 {
+			out += "-" + strings.Join(classes, ",")
+		}
+	}
+
+	err := render(points, "A (mean log2 normalised expression)", "M (log2 fold change)",
+		func(p point) (x, y float64) { return p.a, p.m },
+		decorate(out, "ma", format, first.Filter),
+	)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	err = render(points, "log2 fold change", "-log10 q",
+		func(p point) (x, y float64) { return p.m, -math.Log10(p.q) },
+		decorate(out, "volcano", format, first.Filter),
+	)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func decorate(out, kind, format string, filter int) string {
+	switch filter {
+	case all:
+		return fmt.Sprintf("%s-%s.%s", out, kind, format)
+	case primary:
+		return fmt.Sprintf("%s-U1-%s.%s", out, kind, format)
+	case secondary:
+		return fmt.Sprintf("%s-A10-%s.%s", out, kind, format)
+	default:
+		panic("illegal filter")
+	}
+}
+
+// point is a single MA/volcano plot point.
+type point struct {
+	name  string
+	group string
+
+	m, a float64
+
+	// p is the binomial test p-value and q
+	// the Benjamini-Hochberg adjusted p-value.
+	p, q float64
+}
+
+func pointsOf(rna *Ranged, weights [2]float64) []point {
+	class := strings.Join(rna.Classes, ",")
+	if class == "" {
+		class = "all"
+	}
+
+	var pts []point
+	for _, f := range rna.Features {
+		switch unit {
+		case "bin":
+			c := [2]float64{sum(f.counts[0]), sum(f.counts[1])}
+			if c[0]+c[1] == 0 {
+				continue
+			}
+			pts = append(pts, newPoint(f.Name(), group(f, class, 0), c, weights))
+		case "length":
+			for i := range f.counts[0] {
+				c := [2]float64{f.counts[0][i], f.counts[1][i]}
+				if c[0]+c[1] == 0 {
+					continue
+				}
+				l := rna.Min + i
+				pts = append(pts, newPoint(fmt.Sprintf("%s/%dnt", f.Name(), l), group(f, class, l), c, weights))
+			}
+		default:
+			panic("illegal unit")
+		}
+	}
+	return pts
+}
+
+func group(f *feature, class string, length int) string {
+	switch colour {
+	case "chr":
+		return f.chr.Name()
+	case "class":
+		return class
+	case "length":
+		return fmt.Sprintf("%dnt", length)
+	default:
+		panic("illegal colour")
+	}
+}
+
+func newPoint(name, group string, c, weights [2]float64) point {
+	// A half count pseudocount prevents infinite fold changes.
+	l0 := math.Log2((c[0] + 0.5) / weights[0])
+	l1 := math.Log2((c[1] + 0.5) / weights[1])
+	return point{
+		name:  name,
+		group: group,
+		m:     l1 - l0,
+		a:     (l0 + l1) / 2,
+		p:     binomialTest(c[1], c[0]+c[1], weights[1]/(weights[0]+weights[1])),
+	}
+}
+
+// binomialTest returns the two-sided p-value for observing k successes in n trials with
+// success probability p. Large samples use the normal approximation with continuity
+// correction.
+func binomialTest(k, n, p float64) float64 {
+	if n == 0 {
+		return 1
+	}
+	if n*p*(1-p) > 25 {
+		z := (math.Abs(k-n*p) - 0.5) / math.Sqrt(n*p*(1-p))
+		if z < 0 {
+			return 1
+		}
+		return math.Erfc(z / math.Sqrt2)
+	}
+
+	obs := binomialLogPMF(k, n, p)
+	var pv float64
+	for i := 0.; i <= n; i++ {
+		if lp := binomialLogPMF(i, n, p); lp <= obs+1e-7 {
+			pv += math.Exp(lp)
+		}
+	}
+	return math.Min(pv, 1)
+}
+
+func binomialLogPMF(k, n, p float64) float64 {
+	lc := lgamma(n+1) - lgamma(k+1) - lgamma(n-k+1)
+	return lc + k*math.Log(p) + (n-k)*math.Log1p(-p)
+}
+
+func lgamma(x float64) float64 {
+	l, _ := math.Lgamma(x)
+	return l
+}
+
+// adjust sets the Benjamini-Hochberg adjusted p-values of points.
+func adjust(points []point) {
+	idx := make([]int, len(points))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.Sort(byPIndex{idx, points})
+	n := float64(len(points))
+	q := 1.
+	for i := len(idx) - 1; i >= 0; i-- {
+		pt := &points[idx[i]]
+		q = math.Min(q, pt.p*n/float64(i+1))
+		pt.q = q
+	}
+}
+
+type byPIndex struct {
+	idx    []int
+	points []point
+}
+
+func (p byPIndex) Len() int           { return len(p.idx) }
+func (p byPIndex) Less(i, j int) bool { return p.points[p.idx[i]].p < p.points[p.idx[j]].p }
+func (p byPIndex) Swap(i, j int)      { p.idx[i], p.idx[j] = p.idx[j], p.idx[i] }
+
+// byQ sorts points by q-value, breaking ties by p-value and then by name.
+type byQ []point
+
+func (p byQ) Len() int { return len(p) }
+func (p byQ) Less(i, j int) bool {
+	switch {
+	case p[i].q != p[j].q:
+		return p[i].q < p[j].q
+	case p[i].p != p[j].p:
+		return p[i].p < p[j].p
+	default:
+		return p[i].name < p[j].name
+	}
+}
+func (p byQ) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+
+// qualitative returns the named qualitative palette with n colours, or with as many
+// colours as the palette provides if it has fewer than n. Palettes have at least
+// three colours.
+func qualitative(name string, n int) (palette.Palette, error) {
+	if n < 3 {
+		n = 3
+	}
+	var err error
+	for ; n >= 3; n-- {
+		var p palette.Palette
+		p, err = brewer.GetPalette(brewer.TypeQualitative, name, n)
+		if err == nil {
+			return p, nil
+		}
+	}
+	return nil, err
+}
+
+func render(points []point, xLabel, yLabel string, coords func(point) (x, y float64), file string) error {
+	p, err := plot.New()
+	if err != nil {
+		return err
+	}
+	p.X.Label.Text = xLabel
+	p.Y.Label.Text = yLabel
+	p.Add(plotter.NewGrid())
+
+	var groups []string
+	byGroup := make(map[string]plotter.XYs)
+	for _, pt := range points {
+		x, y := coords(pt)
+		if math.IsInf(y, 0) {
+			// Clamp underflowed p-values.
+			y = -math.Log10(math.SmallestNonzeroFloat64)
+		}
+		if _, ok := byGroup[pt.group]; !ok {
+			groups = append(groups, pt.group)
+		}
+		byGroup[pt.group] = append(byGroup[pt.group], struct{ X, Y float64 }{x, y})
+	}
+	sort.Strings(groups)
+
+	pal, err := qualitative(palname, len(groups))
+	if err != nil {
+		return err
+	}
+	cols := pal.Colors()
+	for i, g := range groups {
+		s, err := plotter.NewScatter(byGroup[g])
+		if err != nil {
+			return err
+		}
+		nc := color.NRGBAModel.Convert(cols[i%len(cols)]).(color.NRGBA)
+		nc.A = 0xb0
+		s.GlyphStyle = draw.GlyphStyle{Color: nc, Radius: vg.Points(1.5), Shape: draw.CircleGlyph{}}
+		p.Add(s)
+		p.Legend.Add(g, s)
+	}
+	p.Legend.Top = true
+
+	if labels > 0 {
+		sorted := make([]point, len(points))
+		copy(sorted, points)
+		sort.Sort(byQ(sorted))
+		n := labels
+		if n > len(sorted) {
+			n = len(sorted)
+		}
+		var lab plotter.XYLabels
+		for _, pt := range sorted[:n] {
+			x, y := coords(pt)
+			if math.IsInf(y, 0) {
+				y = -math.Log10(math.SmallestNonzeroFloat64)
+			}
+			lab.XYs = append(lab.XYs, struct{ X, Y float64 }{x, y})
+			lab.Labels = append(lab.Labels, pt.name)
+		}
+		l, err := plotter.NewLabels(lab)
+		if err != nil {
+			return err
+		}
+		font, err := vg.MakeFont("Helvetica", vg.Points(6))
+		if err != nil {
+			return err
+		}
+		l.TextStyle = draw.TextStyle{Color: color.Gray{0}, Font: font}
+		p.Add(l)
+	}
+
+	return p.Save(20*vg.Centimeter, 15*vg.Centimeter, file)
+}
+
+func sum(f []float64) float64 {
+	var s float64
+	for _, v := range f {
+		s += v
+	}
+	return s
+}
+
+func normaliseByBin(rna *Ranged) ([2]float64, error) {
+	var data [2][]float64
+	for _, f := range rna.Features {
+		for i := range data {
+			data[i] = append(data[i], sum(f.counts[i]))
+		}
+	}
+	var factors [2]float64
+	f, err := norm.TMM(data[:], -1, 0.3, 0.05, -1e10, true)
+	copy(factors[:], f)
+	return factors, err
+}
+
+func normaliseByBlock(rna *Ranged) ([2]float64, error) {
+	var data [2][]float64
+	for _, f := range rna.Features {
+		for i := range data {
+			data[i] = append(data[i], f.counts[i]...)
+		}
+	}
+	var factors [2]float64
+	f, err := norm.TMM(data[:], -1, 0.3, 0.05, -1e10, true)
+	copy(factors[:], f)
+	return factors, err
+}
+
+type Ranged struct {
+	Pair [2]string
+
+	Bin     int
+	Classes []string
+	Filter  int
+
+	Min int
+	Max int
+
+	MinQ   int
+	MinAvQ float64
+	MinID  int
+	MapQ   int
+
+	Totals   [2]int
+	Features []*feature
+}
+
+func readJSON(in string) (rf *Ranged, err error) {
+	jsf, err := os.Open(in)
+	if err != nil {
+		return nil, err
+	}
+	defer jsf.Close()
+
+	type rangedJSONFeatures struct {
+		Pair [2]string `json:"pair"`
+
+		Bin     int      `json:"bin"`
+		Classes []string `json:"classes"`
+		Filter  int      `json:"filter"`
+
+		Min int `json:"min"`
+		Max int `json:"max"`
+
+		MinQ   int     `json:"min-qual"`
+		MinAvQ float64 `json:"min-av-qual"`
+		MinID  int     `json:"min-id"`
+		MapQ   int     `json:"map-qual"`
+
+		Totals   [2]int     `json:"totals"`
+		Features []*feature `json:"features"`
+	}
+
+	var v rangedJSONFeatures
+
+	err = json.NewDecoder(jsf).Decode(&v)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Ranged{
+		Pair:     v.Pair,
+		Bin:      v.Bin,
+		Classes:  v.Classes,
+		Filter:   v.Filter,
+		Min:      v.Min,
+		Max:      v.Max,
+		MinQ:     v.MinQ,
+		MinAvQ:   v.MinAvQ,
+		MinID:    v.MinID,
+		MapQ:     v.MapQ,
+		Totals:   v.Totals,
+		Features: v.Features,
+	}, nil
+}
+
+type feature struct {
+	chr *genome.Chromosome
+	start,
+	end int
+
+	typ string
+
+	counts   [2][]float64
+	supports [2]int
+}
+
+func (f *feature) UnmarshalJSON(b []byte) error {
+	type jsonFeature struct {
+		Chr      string       `json:"chr"`
+		Start    int          `json:"start"`
+		End      int          `json:"end"`
+		Type     string       `json:"type"`
+		Counts   [2][]float64 `json:"counts"`
+		Supports [2]int       `json:"support"`
+	}
+
+	var jf jsonFeature
+	err := json.Unmarshal(b, &jf)
+	if err != nil {
+		return err
+	}
+	*f = feature{
+		chr:      mm10.Chromosomes[index[strings.ToLower(jf.Chr)]],
+		start:    jf.Start,
+		end:      jf.End,
+		typ:      jf.Type,
+		counts:   jf.Counts,
+		supports: jf.Supports,
+	}
+	return nil
+}
+
+func (f *feature) Name() string {
+	return fmt.Sprintf("%s[%d,%d)", f.chr.Name(), f.start, f.end)
+}
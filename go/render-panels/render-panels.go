@@ -0,0 +1,891 @@
+// Copyright ©2013 The bíogo Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// render-panels renders a grid of circular genome plots from a set of length-heat or
+// length-heat-annot-diff json files onto a single figure.
+//
+// The figure is described by a json layout specification:
+//
+//	{
+//	    "rows": 2,
+//	    "cols": 3,
+//	    "scale": "f2-scale.json",
+//	    "normalise": 0,
+//	    "row-labels": ["F2", "F5"],
+//	    "col-labels": ["all", "U1", "A10"],
+//	    "panels": [
+//	        {"in": "wt-f2-diff.json", "label": "A"},
+//	        ...
+//	    ]
+//	}
+//
+// Panels are given in row-major order and empty "in" values leave a blank cell. All panels
+// must be of the same kind, either heat or diff. Every panel uses the union of the panel
+// ranges, replaced by the ranges set in a plotrange scale manifest if one is given. A single
+// legend describing the shared heat, trace and count scales is drawn below the panels.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image/color"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/biogo/biogo/feat"
+	"github.com/biogo/biogo/feat/genome"
+	"github.com/biogo/biogo/feat/genome/mouse/mm10"
+	"github.com/biogo/graphics/rings"
+	"github.com/biogo/rnaseq/norm"
+
+	"github.com/gonum/plot"
+	"github.com/gonum/plot/palette"
+	"github.com/gonum/plot/palette/brewer"
+	"github.com/gonum/plot/plotter"
+	"github.com/gonum/plot/vg"
+	"github.com/gonum/plot/vg/draw"
+)
+
+var (
+	layout string
+	out    string
+	format string
+
+	cell float64
+)
+
+func init() {
+	flag.StringVar(&layout, "layout", "", "json file describing the figure layout.")
+	flag.StringVar(&out, "out", "", "base name of the output figure (default derived from the layout file name).")
+	flag.StringVar(&format, "format", "svg", "specifies the output format of the figure: eps, jpg, jpeg, pdf, png, svg, and tiff.")
+	flag.Float64Var(&cell, "cell", 12, "panel size in centimetres.")
+	help := flag.Bool("help", false, "output this usage message.")
+	flag.Parse()
+	if *help {
+		flag.Usage()
+		os.Exit(0)
+	}
+	if layout == "" || cell <= 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if out == "" {
+		out = strings.TrimSuffix(filepath.Base(layout), filepath.Ext(layout))
+	}
+	for _, s := range []string{"eps", "jpg", "jpeg", "pdf", "png", "svg", "tiff"} {
+		if format == s {
+			return
+		}
+	}
+	flag.Usage()
+	os.Exit(1)
+}
+
+var index = map[string]int{}
+
+func init() {
+	for i, c := range mm10.Chromosomes {
+		index[strings.ToLower(c.Chr)] = i
+	}
+}
+
+const (
+	heatKind = "heat"
+	diffKind = "diff"
+)
+
+// Layout is the figure layout specification.
+type Layout struct {
+	Rows int `json:"rows"`
+	Cols int `json:"cols"`
+
+	Scale     string `json:"scale"`
+	Normalise int    `json:"normalise"`
+
+	RowLabels []string `json:"row-labels"`
+	ColLabels []string `json:"col-labels"`
+
+	Panels []Panel `json:"panels"`
+}
+
+// Panel is a single cell of the figure.
+type Panel struct {
+	In    string `json:"in"`
+	Label string `json:"label"`
+}
+
+func readLayout(in string) (*Layout, error) {
+	f, err := os.Open(in)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var l Layout
+	err = json.NewDecoder(f).Decode(&l)
+	if err != nil {
+		return nil, err
+	}
+	if l.Rows < 1 || l.Cols < 1 {
+		return nil, errors.New("layout: rows and cols must be positive")
+	}
+	if len(l.Panels) > l.Rows*l.Cols {
+		return nil, fmt.Errorf("layout: too many panels: %d > %d", len(l.Panels), l.Rows*l.Cols)
+	}
+	return &l, nil
+}
+
+// scaleManifest is the shared scale written by plotrange.
+type scaleManifest struct {
+	Kind      string     `json:"kind"`
+	Normalise int        `json:"normalise"`
+	Heat      [2]float64 `json:"heat"`
+	Trace     [2]float64 `json:"trace"`
+	Counts    [2]float64 `json:"counts"`
+}
+
+func readScale(in string) (*scaleManifest, error) {
+	f, err := os.Open(in)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var s scaleManifest
+	err = json.NewDecoder(f).Decode(&s)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func main() {
+	l, err := readLayout(layout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	size := vg.Length(cell) * vg.Centimeter
+
+	var (
+		kind   string
+		plots  = make([]*plot.Plot, len(l.Panels))
+		tracks []*panelTracks
+	)
+	for i, pan := range l.Panels {
+		if pan.In == "" {
+			continue
+		}
+		r, err := readJSON(pan.In, l.Normalise)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", err, pan.In)
+			os.Exit(1)
+		}
+		if kind != "" && r.kind != kind {
+			fmt.Fprintf(os.Stderr, "mixed json kinds: %s\n", pan.In)
+			os.Exit(1)
+		}
+		kind = r.kind
+
+		p, err := plot.New()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		t, err := mouseTracks(r, size*0.8)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		p.Add(t.plotters...)
+		p.HideAxes()
+		font, err := vg.MakeFont("Helvetica", 10)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		p.Title.Text = pan.Label
+		p.Title.TextStyle = draw.TextStyle{Color: color.Gray{0}, Font: font}
+
+		plots[i] = p
+		tracks = append(tracks, t)
+	}
+	if len(tracks) == 0 {
+		fmt.Fprintln(os.Stderr, "no panels")
+		os.Exit(1)
+	}
+
+	sc := unionScale(tracks)
+	if l.Scale != "" {
+		s, err := readScale(l.Scale)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if s.Kind != kind {
+			fmt.Fprintf(os.Stderr, "scale manifest is not for %s json: %s\n", kind, s.Kind)
+			os.Exit(1)
+		}
+		if kind == diffKind && s.Normalise != l.Normalise {
+			fmt.Fprintf(os.Stderr, "scale manifest normalisation mismatch: %d != %d\n", s.Normalise, l.Normalise)
+			os.Exit(1)
+		}
+		// As in render-heat and render-diff, zero
+		// manifest ranges are unset and the panel
+		// ranges are kept.
+		if s.Heat[0] != s.Heat[1] {
+			sc.Heat = s.Heat
+		}
+		if !math.IsNaN(sc.Trace[0]) {
+			if s.Trace[0] != 0 {
+				sc.Trace[0] = s.Trace[0]
+			}
+			if s.Trace[1] != 0 {
+				sc.Trace[1] = s.Trace[1]
+			}
+		}
+		if s.Counts[1] != 0 {
+			sc.Counts[1] = s.Counts[1]
+		}
+	}
+	for _, t := range tracks {
+		t.heat.Min, t.heat.Max = sc.Heat[0], sc.Heat[1]
+		if t.trace != nil {
+			t.trace.Min, t.trace.Max = sc.Trace[0], sc.Trace[1]
+		}
+		t.counts.Min, t.counts.Max = 0, sc.Counts[1]
+	}
+
+	err = compose(l, plots, kind, sc, size, decorate(out, format))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func decorate(out, format string) string {
+	return fmt.Sprintf("%s-panels.%s", out, format)
+}
+
+// unionScale returns the union of the track ranges of ts. The trace range is NaN
+// if no track has a trace.
+func unionScale(ts []*panelTracks) scaleManifest {
+	s := scaleManifest{
+		Heat:   [2]float64{math.Inf(1), math.Inf(-1)},
+		Trace:  [2]float64{math.Inf(1), math.Inf(-1)},
+		Counts: [2]float64{0, math.Inf(-1)},
+	}
+	for _, t := range ts {
+		s.Heat[0] = math.Min(s.Heat[0], t.heat.Min)
+		s.Heat[1] = math.Max(s.Heat[1], t.heat.Max)
+		if t.trace != nil {
+			s.Trace[0] = math.Min(s.Trace[0], t.trace.Min)
+			s.Trace[1] = math.Max(s.Trace[1], t.trace.Max)
+		}
+		s.Counts[1] = math.Max(s.Counts[1], t.counts.Max)
+	}
+	if math.IsInf(s.Trace[0], 1) {
+		s.Trace = [2]float64{math.NaN(), math.NaN()}
+	}
+	return s
+}
+
+const (
+	labelBand  = 1 * vg.Centimeter
+	legendBand = 2.5 * vg.Centimeter
+)
+
+func compose(l *Layout, plots []*plot.Plot, kind string, sc scaleManifest, size vg.Length, file string) error {
+	width := labelBand + vg.Length(l.Cols)*size
+	height := labelBand + vg.Length(l.Rows)*size + legendBand
+
+	c, err := draw.NewFormattedCanvas(width, height, format)
+	if err != nil {
+		return err
+	}
+	dc := draw.New(c)
+
+	font, err := vg.MakeFont("Helvetica", 14)
+	if err != nil {
+		return err
+	}
+	sty := draw.TextStyle{Color: color.Gray{0}, Font: font}
+
+	for i, lab := range l.ColLabels {
+		if i >= l.Cols {
+			break
+		}
+		x := labelBand + (vg.Length(i)+0.5)*size
+		dc.FillText(sty, draw.Point{X: x, Y: height - labelBand/2}, -0.5, -0.5, lab)
+	}
+	for i, lab := range l.RowLabels {
+		if i >= l.Rows {
+			break
+		}
+		y := height - labelBand - (vg.Length(i)+0.5)*size
+		dc.FillText(sty, draw.Point{X: labelBand / 2, Y: y}, -0.5, -0.5, lab)
+	}
+
+	for i, p := range plots {
+		if p == nil {
+			continue
+		}
+		row, col := i/l.Cols, i%l.Cols
+		min := draw.Point{
+			X: labelBand + vg.Length(col)*size,
+			Y: height - labelBand - vg.Length(row+1)*size,
+		}
+		p.Draw(draw.Canvas{
+			Canvas:    dc.Canvas,
+			Rectangle: draw.Rectangle{Min: min, Max: draw.Point{X: min.X + size, Y: min.Y + size}},
+		})
+	}
+
+	err = legend(dc, kind, sc, draw.Rectangle{
+		Min: draw.Point{X: labelBand, Y: 0},
+		Max: draw.Point{X: width, Y: legendBand},
+	})
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = c.WriteTo(f)
+	return err
+}
+
+// legend draws the shared heat colour bar and trace and count line keys into r.
+func legend(dc draw.Canvas, kind string, sc scaleManifest, r draw.Rectangle) error {
+	font, err := vg.MakeFont("Helvetica", 9)
+	if err != nil {
+		return err
+	}
+	sty := draw.TextStyle{Color: color.Gray{0}, Font: font}
+
+	var (
+		cols   []color.Color
+		title  string
+		keys   []string
+		lo, hi = sc.Heat[0], sc.Heat[1]
+	)
+	switch kind {
+	case heatKind:
+		cols = palette.Heat(10, 1).Colors()
+		title = "reads/bp"
+		keys = []string{"23-27 nt", "28-32 nt", "unique 5' ends"}
+	case diffKind:
+		cols = brewer.Spectral[11].Colors()
+		title = "normalised difference"
+		keys = []string{"23-27 nt", "28-32 nt", "unique 5' ends (first)", "unique 5' ends (second)"}
+		lo, hi = symmetric(lo, hi)
+	default:
+		panic("illegal kind")
+	}
+
+	// Heat colour bar.
+	w := (r.Max.X - r.Min.X) / 2
+	h := (r.Max.Y - r.Min.Y) / 4
+	x0, y0 := r.Min.X+h, r.Max.Y-2*h
+	step := (w - 2*h) / vg.Length(len(cols))
+	for i, c := range cols {
+		x := x0 + vg.Length(i)*step
+		dc.FillPolygon(c, []draw.Point{
+			{X: x, Y: y0}, {X: x + step, Y: y0},
+			{X: x + step, Y: y0 + h}, {X: x, Y: y0 + h},
+		})
+	}
+	dc.FillText(sty, draw.Point{X: x0, Y: y0}, 0, -1.2, fmt.Sprintf("%.3g", lo))
+	dc.FillText(sty, draw.Point{X: x0 + step*vg.Length(len(cols)), Y: y0}, -1, -1.2, fmt.Sprintf("%.3g", hi))
+	dc.FillText(sty, draw.Point{X: x0 + step*vg.Length(len(cols))/2, Y: y0 + h}, -0.5, 0.2, title)
+
+	// Trace and count keys.
+	ls := traceStyles(kind)
+	x := r.Min.X + w + h
+	y := r.Max.Y - h
+	for i, k := range keys {
+		dc.StrokeLine2(ls[i], x, y, x+h*2, y)
+		dc.FillText(sty, draw.Point{X: x + h*2.5, Y: y}, 0, -0.5, k)
+		y -= (r.Max.Y - r.Min.Y) / 5
+	}
+	ranges := fmt.Sprintf("count max: %.3g", sc.Counts[1])
+	if !math.IsNaN(sc.Trace[0]) {
+		ranges = fmt.Sprintf("trace range: [%.3g,%.3g] %s", sc.Trace[0], sc.Trace[1], ranges)
+	}
+	dc.FillText(sty, draw.Point{X: r.Max.X - h, Y: r.Min.Y + h/2}, -1, 0, ranges)
+
+	return nil
+}
+
+// traceStyles returns the line styles used for the trace and count tracks of the given kind.
+func traceStyles(kind string) []draw.LineStyle {
+	sty := plotter.DefaultLineStyle
+	sty.Width /= 2
+
+	var ls []draw.LineStyle
+	for _, c := range brewer.Set1[3].Colors()[:2] {
+		s := sty
+		nc := color.NRGBAModel.Convert(c).(color.NRGBA)
+		nc.A = 0x80
+		s.Color = nc
+		ls = append(ls, s)
+	}
+	switch kind {
+	case heatKind:
+		s := sty
+		s.Color = color.Gray16{0}
+		ls = append(ls, s)
+	case diffKind:
+		for _, c := range []color.Color{brewer.Set1[4].Colors()[2], brewer.Set1[4].Colors()[3]} {
+			s := sty
+			nc := color.NRGBAModel.Convert(c).(color.NRGBA)
+			nc.A = 0x80
+			s.Color = nc
+			ls = append(ls, s)
+		}
+	default:
+		panic("illegal kind")
+	}
+	return ls
+}
+
+// ranged is the common description of a heat or diff json file.
+type ranged struct {
+	kind string
+
+	bin      int
+	min, max int
+
+	features []rings.Scorer
+}
+
+func readJSON(in string, normalisation int) (*ranged, error) {
+	jsf, err := os.Open(in)
+	if err != nil {
+		return nil, err
+	}
+	defer jsf.Close()
+
+	type rangedJSONFeatures struct {
+		Sample string    `json:"sample"`
+		Pair   [2]string `json:"pair"`
+
+		Bin int `json:"bin"`
+		Min int `json:"min"`
+		Max int `json:"max"`
+
+		Totals   [2]int            `json:"totals"`
+		Features []json.RawMessage `json:"features"`
+	}
+	var v rangedJSONFeatures
+	err = json.NewDecoder(jsf).Decode(&v)
+	if err != nil {
+		return nil, err
+	}
+	if len(v.Features) == 0 {
+		return nil, errors.New("no feature")
+	}
+
+	r := &ranged{bin: v.Bin, min: v.Min, max: v.Max, kind: diffKind, features: make([]rings.Scorer, len(v.Features))}
+	if v.Sample != "" {
+		r.kind = heatKind
+	}
+	fs := make([]*feature, len(v.Features))
+	for i, b := range v.Features {
+		fs[i], err = unmarshalFeature(b, r.kind)
+		if err != nil {
+			return nil, err
+		}
+		r.features[i] = fs[i]
+	}
+	if r.kind == heatKind {
+		return r, nil
+	}
+
+	var weights [2]float64
+	switch normalisation {
+	case 0:
+		weights[0], weights[1] = float64(v.Totals[0]), float64(v.Totals[1])
+	case 1:
+		var data [2][]float64
+		for _, f := range fs {
+			for i := range data {
+				data[i] = append(data[i], sum(f.counts[i]))
+			}
+		}
+		weights, err = tmm(data)
+	case 2:
+		var data [2][]float64
+		for _, f := range fs {
+			for i := range data {
+				data[i] = append(data[i], f.counts[i]...)
+			}
+		}
+		weights, err = tmm(data)
+	default:
+		err = errors.New("illegal normalisation strategy")
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range fs {
+		f.weights = &weights
+	}
+	return r, nil
+}
+
+func sum(f []float64) float64 {
+	var s float64
+	for _, v := range f {
+		s += v
+	}
+	return s
+}
+
+func tmm(data [2][]float64) ([2]float64, error) {
+	var factors [2]float64
+	f, err := norm.TMM(data[:], -1, 0.3, 0.05, -1e10, true)
+	copy(factors[:], f)
+	return factors, err
+}
+
+type location struct {
+	chr *genome.Chromosome
+	start,
+	end int
+}
+
+func (f *location) Start() int { return f.start }
+func (f *location) End() int   { return f.end }
+func (f *location) Len() int   { return f.end - f.start }
+func (f *location) Name() string {
+	return fmt.Sprintf("%s[%d,%d)", f.chr.Name(), f.start, f.end)
+}
+func (f *location) Location() feat.Feature { return f.chr }
+
+// feature is a heat or diff bin. Heat bins hold scores and a single support count,
+// diff bins hold the per read length counts and support counts of each sample and
+// the shared normalisation weights.
+type feature struct {
+	location
+	scores   []float64
+	counts   [2][]float64
+	supports []float64
+	weights  *[2]float64
+}
+
+func (f *feature) Description() string {
+	if f.weights == nil {
+		return "alignment bin"
+	}
+	return "delta"
+}
+func (f *feature) Scores() []float64 {
+	if f.weights == nil {
+		return f.scores
+	}
+	scores := make([]float64, len(f.counts[0]))
+	for i := range scores {
+		scores[i] = f.counts[1][i]/f.weights[1] - f.counts[0][i]/f.weights[0]
+	}
+	return scores
+}
+
+// unmarshalFeature returns the feature of the given kind described by b.
+func unmarshalFeature(b []byte, kind string) (*feature, error) {
+	type jsonFeature struct {
+		Chr     string          `json:"chr"`
+		Start   int             `json:"start"`
+		End     int             `json:"end"`
+		Scores  []float64       `json:"scores"`
+		Counts  [2][]float64    `json:"counts"`
+		Support json.RawMessage `json:"support"`
+	}
+
+	var jf jsonFeature
+	err := json.Unmarshal(b, &jf)
+	if err != nil {
+		return nil, err
+	}
+	f := &feature{
+		location: location{
+			chr:   mm10.Chromosomes[index[strings.ToLower(jf.Chr)]],
+			start: jf.Start,
+			end:   jf.End,
+		},
+		scores: jf.Scores,
+		counts: jf.Counts,
+	}
+	switch kind {
+	case heatKind:
+		// Negative scores mark missing values,
+		// as in render-heat.
+		for i, v := range f.scores {
+			if v < 0 {
+				f.scores[i] = math.NaN()
+			}
+		}
+		var s float64
+		err = json.Unmarshal(jf.Support, &s)
+		f.supports = []float64{s}
+	case diffKind:
+		err = json.Unmarshal(jf.Support, &f.supports)
+	default:
+		panic("illegal kind")
+	}
+	return f, err
+}
+
+const (
+	lomin = 23
+	lomax = 28
+	himin = 28
+	himax = 33
+)
+
+type tfs struct {
+	rings.Scorer
+	minLength int
+}
+
+func (f tfs) Scores() []float64 {
+	var t [2]float64
+	scores := f.Scorer.Scores()
+	if lomin-f.minLength >= 0 && himax-f.minLength < len(scores) {
+		for _, v := range scores[lomin-f.minLength : lomax-f.minLength] {
+			t[0] += v
+		}
+		for _, v := range scores[himin-f.minLength : himax-f.minLength] {
+			t[1] += v
+		}
+	} else {
+		t = [2]float64{math.NaN(), math.NaN()}
+	}
+	return t[:]
+}
+
+type ctfs struct {
+	*feature
+	binLength int
+}
+
+func (f ctfs) Scores() []float64 {
+	factor := float64(f.binLength) / float64(f.Len())
+	s := make([]float64, len(f.supports))
+	for i, v := range f.supports {
+		s[i] = v * factor
+	}
+	return s
+}
+
+type symmetricHeat struct{ *rings.Heat }
+
+func (h symmetricHeat) Configure(ca draw.Canvas, cen draw.Point, _ rings.ArcOfer, inner, outer vg.Length, min, max float64) {
+	h.Heat.Configure(ca, cen, nil, inner, outer, min, max)
+	h.Min, h.Max = symmetric(h.Min, h.Max)
+}
+
+// symmetric returns the range centred on zero that contains [min, max].
+func symmetric(min, max float64) (lo, hi float64) {
+	mag := math.Max(math.Abs(min), math.Abs(max))
+	if mag == -mag {
+		mag++
+	}
+	return -mag, mag
+}
+
+// panelTracks holds the plotters for a panel and the scored tracks that share scales.
+type panelTracks struct {
+	plotters []plot.Plotter
+
+	heat, trace, counts *rings.Scores
+}
+
+func mouseTracks(r *ranged, diameter vg.Length) (*panelTracks, error) {
+	var p []plot.Plotter
+
+	radius := diameter / 2
+
+	// Relative sizes.
+	const (
+		gap = 0.005
+
+		label = 117. / 110.
+
+		countsInner = 25. / 110.
+		countsOuter = 40. / 110.
+
+		heatInner = 45. / 110.
+		heatOuter = 75. / 110.
+
+		traceInner = 80. / 110.
+		traceOuter = 95. / 110.
+
+		karyotypeInner = 100. / 110.
+		karyotypeOuter = 1.
+
+		large = 7. / 110.
+		small = 2. / 110.
+	)
+
+	sty := plotter.DefaultLineStyle
+	sty.Width /= 2
+
+	chr := make([]feat.Feature, len(mm10.Chromosomes))
+	for i, c := range mm10.Chromosomes {
+		chr[i] = c
+	}
+	mm, err := rings.NewGappedBlocks(
+		chr,
+		rings.Arc{rings.Complete / 4 * rings.CounterClockwise, rings.Complete * rings.Clockwise},
+		radius*karyotypeInner, radius*karyotypeOuter, gap,
+	)
+	if err != nil {
+		return nil, err
+	}
+	mm.LineStyle = sty
+	p = append(p, mm)
+
+	bands := make([]feat.Feature, len(mm10.Bands))
+	cens := make([]feat.Feature, 0, len(mm10.Chromosomes))
+	for i, b := range mm10.Bands {
+		bands[i] = colorBand{b}
+		s := b.Start()
+		// This condition depends on p -> q sort order in the $karyotype.Bands variable.
+		// All standard genome packages follow this, though here the test is more general than
+		// actually required since mm is telocentric.
+		if b.Band[0] == 'q' && (s == 0 || mm10.Bands[i-1].Band[0] == 'p') {
+			cens = append(cens, colorBand{&genome.Band{Band: "cen", Desc: "Band", StartPos: s, EndPos: s, Giemsa: "acen", Chr: b.Location()}})
+		}
+	}
+	b, err := rings.NewBlocks(bands, mm, radius*karyotypeInner, radius*karyotypeOuter)
+	if err != nil {
+		return nil, fmt.Errorf("bands: %v", err)
+	}
+	p = append(p, b)
+	c, err := rings.NewBlocks(cens, mm, radius*karyotypeInner, radius*karyotypeOuter)
+	if err != nil {
+		return nil, fmt.Errorf("centromeres: %v", err)
+	}
+	p = append(p, c)
+
+	font, err := vg.MakeFont("Helvetica", radius*large)
+	if err != nil {
+		return nil, err
+	}
+	lb, err := rings.NewLabels(mm, radius*label, rings.NameLabels(mm.Set)...)
+	if err != nil {
+		return nil, err
+	}
+	lb.TextStyle = draw.TextStyle{Color: color.Gray16{0}, Font: font}
+	p = append(p, lb)
+
+	var heat rings.ScoreRenderer
+	switch r.kind {
+	case heatKind:
+		heat = &rings.Heat{Palette: palette.Heat(10, 1).Colors()}
+	case diffKind:
+		heat = symmetricHeat{&rings.Heat{Palette: brewer.Spectral[11].Colors()}}
+	default:
+		panic("illegal kind")
+	}
+	s, err := rings.NewScores(r.features, mm, radius*heatInner, radius*heatOuter, heat)
+	if err != nil {
+		return nil, err
+	}
+	p = append(p, s)
+
+	smallFont, err := vg.MakeFont("Helvetica", radius*small)
+	if err != nil {
+		return nil, err
+	}
+	axis := func() *rings.Axis {
+		return &rings.Axis{
+			Angle:     rings.Complete / 4,
+			Grid:      plotter.DefaultGridLineStyle,
+			LineStyle: sty,
+			Tick: rings.TickConfig{
+				Marker:    plot.DefaultTicks{},
+				LineStyle: sty,
+				Length:    2,
+				Label:     draw.TextStyle{Color: color.Gray16{0}, Font: smallFont},
+			},
+		}
+	}
+	ls := traceStyles(r.kind)
+
+	traces := make([]rings.Scorer, len(r.features))
+	for i, f := range r.features {
+		traces[i] = tfs{Scorer: f, minLength: r.min}
+	}
+	t, err := rings.NewScores(traces, mm, radius*traceInner, radius*traceOuter,
+		&rings.Trace{LineStyles: ls[:2], Join: true, Axis: axis()},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if !math.IsInf(t.Max-t.Min, 0) {
+		p = append(p, t)
+	} else {
+		t = nil
+	}
+
+	counts := make([]rings.Scorer, len(r.features))
+	for i, f := range r.features {
+		counts[i] = ctfs{feature: f.(*feature), binLength: r.bin}
+	}
+	ct, err := rings.NewScores(counts, mm, radius*countsInner, radius*countsOuter,
+		&rings.Trace{LineStyles: ls[2:], Join: true, Axis: axis()},
+	)
+	if err != nil {
+		return nil, err
+	}
+	p = append(p, ct)
+
+	return &panelTracks{plotters: p, heat: s, trace: t, counts: ct}, nil
+}
+
+type colorBand struct {
+	*genome.Band
+}
+
+func (b colorBand) FillColor() color.Color {
+	switch b.Giemsa {
+	case "acen":
+		return color.RGBA{R: 0xff, A: 0xff}
+	case "gneg":
+		return color.Gray{0xff}
+	case "gpos25":
+		return color.Gray{3 * math.MaxUint8 / 4}
+	case "gpos33":
+		return color.Gray{2 * math.MaxUint8 / 3}
+	case "gpos50":
+		return color.Gray{math.MaxUint8 / 2}
+	case "gpos66":
+		return color.Gray{math.MaxUint8 / 3}
+	case "gpos75":
+		return color.Gray{math.MaxUint8 / 4}
+	case "gpos100":
+		return color.Gray{0x0}
+	default:
+		panic("unexpected giemsa value")
+	}
+}
+
+func (b colorBand) LineStyle() draw.LineStyle {
+	switch b.Giemsa {
+	case "acen":
+		return draw.LineStyle{Color: color.RGBA{R: 0xff, A: 0xff}, Width: 1}
+	case "gneg", "gpos25", "gpos33", "gpos50", "gpos66", "gpos75", "gpos100":
+		return draw.LineStyle{}
+	default:
+		panic("unexpected giemsa value")
+	}
+}
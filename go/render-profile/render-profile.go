@@ -0,0 +1,660 @@
+// Copyright ©2013 The bíogo Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// render-profile renders sense and antisense read coverage along repeat consensus sequences
+// from the output of hit-profile.
+//
+// Input may be either the json or the legacy scov output of hit-profile. Multiple inputs are
+// overlaid on a single plot for each selected repeat type, with sense coverage drawn above the
+// axis and antisense coverage drawn below it. Inputs may be labelled, for example to distinguish
+// wild-type and mutant samples, by giving them as label=file.
+//
+// Coverage may be drawn as raw counts or normalised per million reads or per genomic copy.
+// Normalised coverage requires json input. Consensus features such as 5'UTR, ORF1 and ORF2
+// may be annotated from a GFF file with sequence names corresponding to repeat types and
+// coordinates on the consensus sequence.
+//
+// Differential json output of hit-profile, produced with its vs option, is rendered as the
+// per million difference or log2 ratio between groups along the consensus, with windows
+// showing a significant difference after Benjamini-Hochberg adjustment marked.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image/color"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/biogo/biogo/io/featio"
+	"github.com/biogo/biogo/io/featio/gff"
+
+	"github.com/gonum/plot"
+	"github.com/gonum/plot/palette/brewer"
+	"github.com/gonum/plot/plotter"
+	"github.com/gonum/plot/vg"
+	"github.com/gonum/plot/vg/draw"
+)
+
+var (
+	in     set
+	types  set
+	annot  string
+	out    string
+	format string
+
+	norm    string
+	smooth  int
+	palname string
+
+	diff  string
+	alpha float64
+)
+
+const (
+	all = iota
+	primary
+	secondary
+)
+
+type set []string
+
+func (s *set) String() string {
+	if len(*s) == 0 {
+		return `""`
+	}
+	return strings.Join(*s, ",")
+}
+func (s *set) Set(value string) error {
+	*s = append(*s, strings.Split(value, ",")...)
+	if len(*s) == 0 {
+		return errors.New("empty set")
+	}
+	return nil
+}
+
+func init() {
+	flag.Var(&in, "in", "comma separated set of hit-profile files to be rendered, optionally as label=file\n\t(may be invoked multiple times).")
+	flag.Var(&types, "type", "comma separated set of repeat types to render (default all types in the first input).")
+	flag.StringVar(&annot, "annot", "", "file name of a GFF file of consensus features with repeat types as sequence names.")
+	flag.StringVar(&out, "out", "", "base name for output files (default derived from the first input).")
+	flag.StringVar(&format, "format", "svg", "specifies the output format of the figure: eps, jpg, jpeg, pdf, png, svg, and tiff.")
+	flag.StringVar(&norm, "norm", "per-million", "coverage normalisation: counts, per-million or per-copy.")
+	flag.IntVar(&smooth, "smooth", 1, "width of the moving average window applied to coverage.")
+	flag.StringVar(&palname, "palette", "Set1", "specify the qualitative palette name for sample colours.")
+	flag.StringVar(&diff, "diff", "log-ratio", "value rendered for differential input: log-ratio or difference.")
+	flag.Float64Var(&alpha, "alpha", 0.05, "adjusted p-value threshold for marking differential windows.")
+	help := flag.Bool("help", false, "output this usage message.")
+	flag.Parse()
+	if *help {
+		flag.Usage()
+		os.Exit(0)
+	}
+	if len(in) == 0 || smooth < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	switch norm {
+	case "counts", "per-million", "per-copy":
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+	switch diff {
+	case "log-ratio", "difference":
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+	for _, s := range []string{"eps", "jpg", "jpeg", "pdf", "png", "svg", "tiff"} {
+		if format == s {
+			return
+		}
+	}
+	flag.Usage()
+	os.Exit(1)
+}
+
+// Profiles is the json output of hit-profile. Vs and Window
+// are only present in differential output and Ends is empty
+// for legacy input.
+type Profiles struct {
+	Files   []string `json:"files"`
+	Vs      []string `json:"vs"`
+	Classes []string `json:"classes"`
+	Filter  int      `json:"filter"`
+	Strict  bool     `json:"strict"`
+	Ends    string   `json:"ends"`
+	Window  int      `json:"window"`
+
+	// Reads is a single count for profiles and
+	// a pair of counts for differential profiles.
+	Reads json.RawMessage `json:"reads"`
+
+	Profiles []Profile `json:"profiles"`
+}
+
+// Profile is the hit profile of a single repeat type.
+type Profile struct {
+	Class     string `json:"class"`
+	Type      string `json:"type"`
+	Consensus int    `json:"consensus"`
+	Copies    int    `json:"copies"`
+
+	Reads json.RawMessage `json:"reads"`
+
+	Counts     Strands `json:"counts"`
+	PerMillion Strands `json:"per-million"`
+	PerCopy    Strands `json:"per-copy"`
+
+	Difference Strands  `json:"difference"`
+	LogRatio   Strands  `json:"log-ratio"`
+	Windows    []Window `json:"windows"`
+}
+
+// Window is a differential profile test window.
+type Window struct {
+	Start  int     `json:"start"`
+	End    int     `json:"end"`
+	Strand string  `json:"strand"`
+	Counts [2]int  `json:"counts"`
+	Ratio  float64 `json:"log-ratio"`
+	P      float64 `json:"p"`
+	Q      float64 `json:"q"`
+}
+
+// Strands holds antisense and sense coverage.
+type Strands struct {
+	Minus []float64 `json:"minus"`
+	Plus  []float64 `json:"plus"`
+}
+
+// sample is a labelled hit-profile input.
+type sample struct {
+	label  string
+	legacy bool
+	*Profiles
+}
+
+func (s sample) profile(typ string) (Profile, bool) {
+	for _, p := range s.Profiles.Profiles {
+		if p.Type == typ {
+			return p, true
+		}
+	}
+	return Profile{}, false
+}
+
+func readProfiles(path string) (*Profiles, bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		b, err := r.Peek(1)
+		if err != nil {
+			return nil, false, fmt.Errorf("%v: %v", err, path)
+		}
+		if b[0] != ' ' && b[0] != '\t' && b[0] != '\n' && b[0] != '\r' {
+			break
+		}
+		r.ReadByte()
+	}
+	b, _ := r.Peek(1)
+	if b[0] == '{' {
+		var p Profiles
+		err = json.NewDecoder(r).Decode(&p)
+		if err != nil {
+			return nil, false, fmt.Errorf("%v: %v", err, path)
+		}
+		return &p, false, nil
+	}
+	p, err := readSCOV(r)
+	if err != nil {
+		return nil, false, fmt.Errorf("%v: %v", err, path)
+	}
+	return p, true, nil
+}
+
+// readSCOV reads legacy hit-profile output of class, type, strand, position and
+// count lines, with a trailing read length field when written with -bylength.
+// Counts of each read length are summed. Only raw counts are available from
+// legacy input.
+func readSCOV(r io.Reader) (*Profiles, error) {
+	idx := make(map[string]int)
+	var p Profiles
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		if sc.Text() == "" {
+			continue
+		}
+		f := strings.Split(sc.Text(), "\t")
+		if len(f) != 5 && len(f) != 6 {
+			return nil, fmt.Errorf("unexpected number of fields: %d", len(f))
+		}
+		pos, err := strconv.Atoi(f[3])
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.ParseFloat(f[4], 64)
+		if err != nil {
+			return nil, err
+		}
+		i, ok := idx[f[1]]
+		if !ok {
+			i = len(p.Profiles)
+			idx[f[1]] = i
+			p.Profiles = append(p.Profiles, Profile{Class: f[0], Type: f[1]})
+		}
+		c := &p.Profiles[i].Counts
+		switch f[2] {
+		case "minus":
+			c.Minus = extend(c.Minus, pos)
+			c.Minus[pos] += n
+		case "plus":
+			c.Plus = extend(c.Plus, pos)
+			c.Plus[pos] += n
+		default:
+			return nil, fmt.Errorf("illegal strand: %q", f[2])
+		}
+	}
+	return &p, sc.Err()
+}
+
+func extend(v []float64, i int) []float64 {
+	if i < len(v) {
+		return v
+	}
+	t := make([]float64, i+1)
+	copy(t, v)
+	return t
+}
+
+// consensusFeats returns the consensus features in the GFF file annot grouped by
+// repeat type.
+func consensusFeats(annot string) (map[string][]*gff.Feature, error) {
+	f, err := os.Open(annot)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	feats := make(map[string][]*gff.Feature)
+	fs := featio.NewScanner(gff.NewReader(f))
+	for fs.Next() {
+		f := fs.Feat().(*gff.Feature)
+		feats[f.SeqName] = append(feats[f.SeqName], f)
+	}
+	return feats, fs.Error()
+}
+
+func main() {
+	var samples []sample
+	for _, v := range in {
+		label, path := "", v
+		if i := strings.Index(v, "="); i >= 0 {
+			label, path = v[:i], v[i+1:]
+		}
+		if label == "" {
+			label = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		}
+		p, legacy, err := readProfiles(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if legacy && norm != "counts" {
+			fmt.Fprintf(os.Stderr, "%s normalisation requires json input: %s\n", norm, path)
+			os.Exit(1)
+		}
+		if len(samples) != 0 && (p.Filter != samples[0].Filter || (len(p.Vs) == 0) != (len(samples[0].Vs) == 0)) {
+			fmt.Fprintf(os.Stderr, "incompatible input: %s\n", path)
+			os.Exit(1)
+		}
+		if len(samples) != 0 && p.Ends != samples[0].Ends {
+			fmt.Fprintf(os.Stderr, "mixed ends modes %q and %q: %s\n", samples[0].Ends, p.Ends, path)
+			os.Exit(1)
+		}
+		samples = append(samples, sample{label: label, legacy: legacy, Profiles: p})
+	}
+
+	if len(types) == 0 {
+		for _, p := range samples[0].Profiles.Profiles {
+			types = append(types, p.Type)
+		}
+		sort.Strings(types)
+	}
+
+	var feats map[string][]*gff.Feature
+	if annot != "" {
+		var err error
+		feats, err = consensusFeats(annot)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	if out == "" {
+		p := in[0][strings.Index(in[0], "=")+1:]
+		out = strings.TrimSuffix(filepath.Base(p), filepath.Ext(p))
+	}
+
+	for _, typ := range types {
+		var err error
+		if len(samples[0].Vs) != 0 {
+			err = renderDiff(samples, typ, feats[typ], decorate(out, typ, "diff", format, samples[0].Filter))
+		} else {
+			err = render(samples, typ, feats[typ], decorate(out, typ, "profile", format, samples[0].Filter))
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+}
+
+func decorate(out, typ, kind, format string, filter int) string {
+	switch filter {
+	case all:
+		return fmt.Sprintf("%s-%s-%s.%s", out, typ, kind, format)
+	case primary:
+		return fmt.Sprintf("%s-U1-%s-%s.%s", out, typ, kind, format)
+	case secondary:
+		return fmt.Sprintf("%s-A10-%s-%s.%s", out, typ, kind, format)
+	default:
+		panic("illegal filter")
+	}
+}
+
+// coverage returns the selected normalised coverage of p.
+func coverage(p Profile) Strands {
+	switch norm {
+	case "counts":
+		return p.Counts
+	case "per-million":
+		return p.PerMillion
+	case "per-copy":
+		return p.PerCopy
+	default:
+		panic("illegal normalisation")
+	}
+}
+
+// movingAverage returns the centred moving average of v over a window of width w.
+func movingAverage(v []float64, w int) []float64 {
+	if w <= 1 {
+		return v
+	}
+	m := make([]float64, len(v))
+	for i := range v {
+		lo, hi := i-w/2, i-w/2+w
+		if lo < 0 {
+			lo = 0
+		}
+		if hi > len(v) {
+			hi = len(v)
+		}
+		var sum float64
+		for _, x := range v[lo:hi] {
+			sum += x
+		}
+		m[i] = sum / float64(hi-lo)
+	}
+	return m
+}
+
+func xys(v []float64, sign float64) plotter.XYs {
+	xy := make(plotter.XYs, len(v))
+	for i, y := range v {
+		xy[i].X = float64(i)
+		xy[i].Y = sign * y
+	}
+	return xy
+}
+
+var yLabels = map[string]string{
+	"counts":      "Coverage (reads)",
+	"per-million": "Coverage (reads per million)",
+	"per-copy":    "Coverage (reads per copy)",
+}
+
+func render(samples []sample, typ string, feats []*gff.Feature, file string) error {
+	p, err := plot.New()
+	if err != nil {
+		return err
+	}
+	p.Title.Text = typ
+	p.X.Label.Text = "Consensus position (bp)"
+	p.Y.Label.Text = yLabels[norm] + " - antisense below axis"
+	p.Add(plotter.NewGrid())
+
+	pal, err := brewer.GetPalette(brewer.TypeQualitative, palname, 9)
+	if err != nil {
+		return err
+	}
+	cols := pal.Colors()
+
+	var (
+		found      bool
+		consensus  int
+		ymin, ymax float64
+	)
+	for i, s := range samples {
+		prof, ok := s.profile(typ)
+		if !ok {
+			continue
+		}
+		found = true
+		if prof.Consensus > consensus {
+			consensus = prof.Consensus
+		}
+		c := coverage(prof)
+		var legend *plotter.Line
+		for _, st := range []struct {
+			v    []float64
+			sign float64
+		}{
+			{v: c.Plus, sign: 1},
+			{v: c.Minus, sign: -1},
+		} {
+			if len(st.v) == 0 {
+				continue
+			}
+			v := movingAverage(st.v, smooth)
+			for _, y := range v {
+				ymin = math.Min(ymin, st.sign*y)
+				ymax = math.Max(ymax, st.sign*y)
+			}
+			l, err := plotter.NewLine(xys(v, st.sign))
+			if err != nil {
+				return err
+			}
+			l.Color = cols[i%len(cols)]
+			l.Width = vg.Points(0.75)
+			p.Add(l)
+			legend = l
+		}
+		if legend != nil {
+			p.Legend.Add(s.label, legend)
+		}
+	}
+	if !found {
+		return fmt.Errorf("no profile for %s", typ)
+	}
+	p.Legend.Top = true
+
+	if len(feats) != 0 {
+		err = addFeatures(p, feats, ymin, ymax)
+		if err != nil {
+			return err
+		}
+	}
+	if consensus > 0 {
+		p.X.Min = 0
+		p.X.Max = math.Max(p.X.Max, float64(consensus))
+	}
+
+	return p.Save(25*vg.Centimeter, 12*vg.Centimeter, file)
+}
+
+// addFeatures adds consensus features to p as bars in a band below the coverage
+// data range given by ymin and ymax. Features are drawn at the one-based consensus
+// positions used by the coverage.
+func addFeatures(p *plot.Plot, feats []*gff.Feature, ymin, ymax float64) error {
+	span := ymax - ymin
+	if span == 0 {
+		span = 1
+	}
+	y := ymin - 0.1*span
+
+	var lab plotter.XYLabels
+	for _, f := range feats {
+		l, err := plotter.NewLine(plotter.XYs{{X: float64(f.FeatStart + 1), Y: y}, {X: float64(f.FeatEnd), Y: y}})
+		if err != nil {
+			return err
+		}
+		l.Color = color.Gray{0x80}
+		l.Width = vg.Points(6)
+		p.Add(l)
+
+		lab.XYs = append(lab.XYs, struct{ X, Y float64 }{float64(f.FeatStart + 1), y - 0.08*span})
+		lab.Labels = append(lab.Labels, f.Feature)
+	}
+	l, err := plotter.NewLabels(lab)
+	if err != nil {
+		return err
+	}
+	font, err := vg.MakeFont("Helvetica", vg.Points(7))
+	if err != nil {
+		return err
+	}
+	l.TextStyle = draw.TextStyle{Color: color.Gray{0}, Font: font}
+	p.Add(l)
+
+	return nil
+}
+
+var diffLabels = map[string]string{
+	"log-ratio":  "log2 ratio",
+	"difference": "Difference (reads per million)",
+}
+
+// renderDiff renders the differential profiles of typ in samples, marking
+// windows with a Benjamini-Hochberg adjusted p-value below alpha.
+func renderDiff(samples []sample, typ string, feats []*gff.Feature, file string) error {
+	p, err := plot.New()
+	if err != nil {
+		return err
+	}
+	p.Title.Text = typ
+	p.X.Label.Text = "Consensus position (bp)"
+	p.Y.Label.Text = diffLabels[diff] + " - sense solid, antisense dashed"
+	p.Add(plotter.NewGrid())
+
+	pal, err := brewer.GetPalette(brewer.TypeQualitative, palname, 9)
+	if err != nil {
+		return err
+	}
+	cols := pal.Colors()
+
+	var (
+		found      bool
+		consensus  int
+		ymin, ymax float64
+	)
+	for i, s := range samples {
+		prof, ok := s.profile(typ)
+		if !ok {
+			continue
+		}
+		found = true
+		if prof.Consensus > consensus {
+			consensus = prof.Consensus
+		}
+		vals := prof.LogRatio
+		if diff == "difference" {
+			vals = prof.Difference
+		}
+		var legend *plotter.Line
+		for _, st := range []struct {
+			v      []float64
+			dashes []vg.Length
+		}{
+			{v: vals.Plus},
+			{v: vals.Minus, dashes: []vg.Length{vg.Points(2), vg.Points(2)}},
+		} {
+			if len(st.v) == 0 {
+				continue
+			}
+			v := movingAverage(st.v, smooth)
+			for _, y := range v {
+				ymin = math.Min(ymin, y)
+				ymax = math.Max(ymax, y)
+			}
+			l, err := plotter.NewLine(xys(v, 1))
+			if err != nil {
+				return err
+			}
+			l.Color = cols[i%len(cols)]
+			l.Width = vg.Points(0.75)
+			l.Dashes = st.dashes
+			p.Add(l)
+			if legend == nil {
+				legend = l
+			}
+		}
+		if legend != nil {
+			p.Legend.Add(s.label, legend)
+		}
+
+		var sig plotter.XYs
+		for _, w := range prof.Windows {
+			if w.Q >= alpha {
+				continue
+			}
+			y := 0.
+			if diff == "log-ratio" {
+				y = w.Ratio
+			}
+			sig = append(sig, struct{ X, Y float64 }{float64(w.Start+w.End) / 2, y})
+		}
+		if len(sig) != 0 {
+			sc, err := plotter.NewScatter(sig)
+			if err != nil {
+				return err
+			}
+			sc.GlyphStyle = draw.GlyphStyle{Color: cols[i%len(cols)], Radius: vg.Points(2), Shape: draw.CircleGlyph{}}
+			p.Add(sc)
+		}
+	}
+	if !found {
+		return fmt.Errorf("no profile for %s", typ)
+	}
+	p.Legend.Top = true
+
+	if len(feats) != 0 {
+		err = addFeatures(p, feats, ymin, ymax)
+		if err != nil {
+			return err
+		}
+	}
+	if consensus > 0 {
+		p.X.Min = 0
+		p.X.Max = math.Max(p.X.Max, float64(consensus))
+	}
+
+	return p.Save(25*vg.Centimeter, 12*vg.Centimeter, file)
+}
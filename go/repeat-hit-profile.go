@@ -10,12 +10,14 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"strconv"
 	"strings"
 
 	"github.com/biogo/biogo/feat/genome/mouse/mm10"
 	"github.com/biogo/biogo/io/featio"
 	"github.com/biogo/biogo/io/featio/gff"
+	"github.com/biogo/biogo/seq"
 	"github.com/biogo/boom"
 	"github.com/biogo/store/interval"
 )
@@ -32,6 +34,10 @@ var (
 	classes set
 	filter int
 	strict bool
+
+	bad string
+
+	mode string
 )
 
 type set []string
@@ -56,6 +62,8 @@ func init() {
 	flag.Var(&classes, "class", "comma separated set of annotation classes to analyse.")
 	flag.IntVar(&filter, "f", 0, "filter on piwi type 0: no filter, 1: primary, 2: secondary.")
 	flag.BoolVar(&strict, "strict", false, "filter rejects ambiguous reads.")
+	flag.StringVar(&mode, "mode", "copies", "counting mode: copies - each repeat copy hit once, reads - read coverage,\n\tfive - read 5' ends, weighted - copy coverage weighted by reads hitting the copy.")
+	flag.StringVar(&bad, "bad", "", "file name to write unparseable repeat annotations to.")
 	help := flag.Bool("help", false, "output this usage message.")
 	flag.Parse()
 	if *help {
@@ -66,6 +74,12 @@ func init() {
 		flag.Usage()
 		os.Exit(1)
 	}
+	switch mode {
+	case "copies", "reads", "five", "weighted":
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
 }
 
 var index = map[string]int{}
@@ -83,8 +97,16 @@ func min(a, b int) int {
 	return b
 }
 
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
 type intGff struct {
 	*gff.Feature
+	repeat
 	uintptr
 }
 
@@ -94,6 +116,59 @@ func (f intGff) Overlap(b interval.IntRange) bool {
 }
 func (f intGff) ID() uintptr { return f.uintptr }
 
+// repeat holds the consensus details of a RepeatMasker repeat annotation.
+type repeat struct {
+	name, class string
+
+	// start and end are the one-based consensus
+	// coordinates of the aligned region and left is
+	// the length of the consensus following end.
+	start, end, left int
+}
+
+// parseRepeat parses the RepeatMasker repeat attribute of a feature on the given strand.
+// Plus strand matches are described by name, class, start, end and (left), while
+// complement matches are described by name, class, (left), end and start.
+func parseRepeat(att string, strand seq.Strand) (repeat, error) {
+	fields := strings.Fields(att)
+	if len(fields) != 5 {
+		return repeat{}, fmt.Errorf("unexpected number of repeat fields: %d", len(fields))
+	}
+	r := repeat{name: fields[0], class: fields[1]}
+	var start, end, left string
+	switch strand {
+	case seq.Plus:
+		start, end, left = fields[2], fields[3], fields[4]
+	case seq.Minus:
+		left, end, start = fields[2], fields[3], fields[4]
+	default:
+		return repeat{}, errors.New("unstranded repeat")
+	}
+	if !strings.HasPrefix(left, "(") || !strings.HasSuffix(left, ")") {
+		return repeat{}, fmt.Errorf("missing parentheses in left field: %q", left)
+	}
+	var err error
+	r.start, err = strconv.Atoi(start)
+	if err != nil {
+		return repeat{}, err
+	}
+	r.end, err = strconv.Atoi(end)
+	if err != nil {
+		return repeat{}, err
+	}
+	r.left, err = strconv.Atoi(left[1 : len(left)-1])
+	if err != nil {
+		return repeat{}, err
+	}
+	if r.start < 1 || r.end < r.start || r.left < 0 {
+		return repeat{}, fmt.Errorf("invalid consensus coordinates: start=%d end=%d left=%d", r.start, r.end, r.left)
+	}
+	return r, nil
+}
+
+// consensus returns the length of the repeat's consensus sequence.
+func (r repeat) consensus() int { return r.end + r.left }
+
 func annotFeats(annot string, classes, names []string) ([]interval.IntTree, error) {
 	ntab := make(map[string]int, len(names))
 	for i, n := range names {
@@ -102,15 +177,22 @@ func annotFeats(annot string, classes, names []string) ([]interval.IntTree, erro
 
 	ts := make([]interval.IntTree, len(names))
 
-	cm := make(map[string]struct{})
-	for _, c := range classes {
-		cm[c] = struct{}{}
-	}
-
 	f, err := os.Open(annot)
 	if err != nil {
 		return nil, err
 	}
+	var (
+		w    io.Writer
+		nBad int
+	)
+	if bad != "" {
+		bf, err := os.Create(bad)
+		if err != nil {
+			return nil, err
+		}
+		defer bf.Close()
+		w = bf
+	}
 	fs := featio.NewScanner(gff.NewReader(f))
 	for id := uintptr(0); fs.Next(); id++ {
 		f := fs.Feat().(*gff.Feature)
@@ -120,19 +202,23 @@ func annotFeats(annot string, classes, names []string) ([]interval.IntTree, erro
 			// Ignore non-repeat features.
 			continue
 		}
-		repeatFields := strings.Fields(att)
-		class = f.Feature + "/" + repeatFields[1]
-		if _, ok := cm[class]; !ok {
-			last := strings.LastIndex(class, "/")
-			if last == strings.Index(class, "/") {
-				continue
-			}
-			if _, ok := cm[class[:last]]; !ok {
-				continue
+		rep, err := parseRepeat(att, f.FeatStrand)
+		if err != nil {
+			nBad++
+			if w != nil {
+				_, err = fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%v\n", f.SeqName, f.FeatStart, f.FeatEnd, f.FeatStrand, att, err)
+				if err != nil {
+					return nil, err
+				}
 			}
+			continue
+		}
+		class = f.Feature + "/" + rep.class + "/" + rep.name
+		if !classMatch(classes, class) {
+			continue
 		}
 		if chr, ok := ntab[f.SeqName]; ok {
-			ts[chr].Insert(intGff{f, id}, true)
+			ts[chr].Insert(intGff{f, rep, id}, true)
 		}
 	}
 	if err := fs.Error(); err != nil {
@@ -141,10 +227,28 @@ func annotFeats(annot string, classes, names []string) ([]interval.IntTree, erro
 	for i := range ts {
 		ts[i].AdjustRanges()
 	}
+	if nBad != 0 {
+		fmt.Fprintf(os.Stderr, "skipped %d unparseable repeat annotations\n", nBad)
+	}
 
 	return ts, nil
 }
 
+// classMatch returns whether class or any of its ancestors matches a glob in classes.
+func classMatch(classes []string, class string) bool {
+	for i := 0; i <= len(class); i++ {
+		if i < len(class) && class[i] != '/' {
+			continue
+		}
+		for _, c := range classes {
+			if ok, _ := path.Match(c, class[:i]); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 type intBam struct {
 	*boom.Record
 }
@@ -220,12 +324,20 @@ func (v *vector) inc(i int) {
 	}
 }
 
-func mustAtoi(s string) int {
-	i, err := strconv.Atoi(s)
-	if err != nil {
-		panic(err)
+// consensusPos returns the consensus position of the genomic position pos within f.
+func consensusPos(f intGff, pos int) int {
+	if f.FeatStrand == seq.Minus {
+		return f.FeatEnd - 1 - pos + f.start
 	}
-	return i
+	return pos - f.FeatStart + f.start
+}
+
+// fivePrime returns the genomic position of the 5' end of r.
+func fivePrime(r *boom.Record) int {
+	if r.Flags()&boom.Reverse != 0 {
+		return r.End() - 1
+	}
+	return r.Start()
 }
 
 func main() {
@@ -288,30 +400,35 @@ func main() {
 				feats[r.RefID()].DoMatching(func(iv interval.IntInterface) (done bool) {
 					f := iv.(intGff)
 
-					if _, ok := seen[f.Feature]; ok {
-						return
+					if mode == "copies" {
+						if _, ok := seen[f.Feature]; ok {
+							return
+						}
+						seen[f.Feature] = struct{}{}
 					}
-					seen[f.Feature] = struct{}{}
 
 					if f.Feature.Feature != "repeat" {
 						return
 					}
-					att := f.FeatAttributes.Get("repeat")
-					if att == "" {
-						return
-					}
-					fields := strings.Fields(att)
-
-					s := mustAtoi(fields[2])
-					e := mustAtoi(fields[3])
-					v, ok := vm[fields[0]]
+					v, ok := vm[f.name]
 					if !ok {
 						v = &vector{}
-						vm[fields[0]] = v
-						fm[fields[0]] = fields[1]
+						vm[f.name] = v
+						fm[f.name] = f.class
 					}
-					for i := e; i >= s; i-- {
-						v.inc(i)
+					switch mode {
+					case "copies", "weighted":
+						for i := f.end; i >= f.start; i-- {
+							v.inc(i)
+						}
+					case "reads":
+						for pos := max(r.Start(), f.FeatStart); pos < min(r.End(), f.FeatEnd); pos++ {
+							v.inc(consensusPos(f, pos))
+						}
+					case "five":
+						if pos := fivePrime(r); f.FeatStart <= pos && pos < f.FeatEnd {
+							v.inc(consensusPos(f, pos))
+						}
 					}
 					return
 				}, intBam{r})
@@ -323,7 +440,7 @@ func main() {
 
 	for typ, vec := range vm {
 		for pos, val := range *vec {
-			fmt.Printf("%s\t%s\t%d\t%d\n", fm[typ], typ, pos, val)
+			fmt.Printf("%s\t%s\t%d\t%d\t%s\n", fm[typ], typ, pos, val, mode)
 		}
 	}
 }
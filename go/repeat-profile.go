@@ -1,21 +1,201 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"os"
+	"path"
+	"sort"
 	"strconv"
 	"strings"
 
 	"github.com/biogo/biogo/io/featio"
 	"github.com/biogo/biogo/io/featio/gff"
+	"github.com/biogo/biogo/seq"
 )
 
-func mustAtoi(s string) int {
-	i, err := strconv.Atoi(s)
+var (
+	age     string
+	ageBins []float64
+
+	classes set
+	tree    bool
+)
+
+type set []string
+
+func (s *set) String() string {
+	if len(*s) == 0 {
+		return `""`
+	}
+	return strings.Join(*s, ",")
+}
+func (s *set) Set(value string) error {
+	*s = append(*s, strings.Split(value, ",")...)
+	if len(*s) == 0 {
+		return errors.New("empty set")
+	}
+	return nil
+}
+
+func init() {
+	flag.Var(&classes, "class", "comma separated set of repeat class globs to analyse, for example repeat/LINE/* (default all repeats).")
+	flag.BoolVar(&tree, "tree", false, "output class, family and subfamily rollups of copies and bases instead of profiles;\n\tnot available with -age.")
+	flag.StringVar(&age, "age", "", "repeat age measure used to stratify copies: score - GFF score, or the name of a\n\tGFF attribute holding RepeatMasker divergence. Empty disables stratification.")
+	bins := flag.String("bins", "5,10,15,20,25", "comma separated ascending age bin boundaries.")
+	help := flag.Bool("help", false, "output this usage message.")
+	flag.Parse()
+	if *help {
+		flag.Usage()
+		os.Exit(0)
+	}
+	if tree && age != "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if age != "" {
+		var err error
+		ageBins, err = parseBins(*bins)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+}
+
+// parseBins returns the ascending bin boundaries described by the comma separated list in s.
+func parseBins(s string) ([]float64, error) {
+	var b []float64
+	for _, f := range strings.Split(s, ",") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil {
+			return nil, err
+		}
+		if len(b) != 0 && v <= b[len(b)-1] {
+			return nil, fmt.Errorf("age bins not ascending: %s", s)
+		}
+		b = append(b, v)
+	}
+	return b, nil
+}
+
+// ageOf returns the age measure of f, either the GFF score or the value
+// of the attribute named by age.
+func ageOf(f *gff.Feature) (float64, error) {
+	if age == "score" {
+		if f.FeatScore == nil {
+			return 0, errors.New("missing score")
+		}
+		return *f.FeatScore, nil
+	}
+	att := strings.Trim(f.FeatAttributes.Get(age), `"`)
+	if att == "" {
+		return 0, fmt.Errorf("missing %s attribute", age)
+	}
+	return strconv.ParseFloat(att, 64)
+}
+
+// binOf returns the index of the bin holding v given the bin boundaries in edges.
+// Bin i holds values in [edges[i-1], edges[i]).
+func binOf(v float64, edges []float64) int {
+	return sort.Search(len(edges), func(i int) bool { return v < edges[i] })
+}
+
+// classMatch returns whether class or any of its ancestors matches a glob in classes.
+func classMatch(classes []string, class string) bool {
+	for i := 0; i <= len(class); i++ {
+		if i < len(class) && class[i] != '/' {
+			continue
+		}
+		for _, c := range classes {
+			if ok, _ := path.Match(c, class[:i]); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ancestors returns the slash separated class path and each of its ancestors, root first.
+func ancestors(class string) []string {
+	var a []string
+	for i := 0; i < len(class); i++ {
+		if class[i] == '/' {
+			a = append(a, class[:i])
+		}
+	}
+	return append(a, class)
+}
+
+// node holds the rolled up counts of a level of the class hierarchy.
+type node struct {
+	copies int
+	bases  int
+}
+
+// byPath sorts class paths so that each node precedes its descendants.
+type byPath []string
+
+func (p byPath) Len() int { return len(p) }
+func (p byPath) Less(i, j int) bool {
+	a, b := strings.Split(p[i], "/"), strings.Split(p[j], "/")
+	for k := 0; k < len(a) && k < len(b); k++ {
+		if a[k] != b[k] {
+			return a[k] < b[k]
+		}
+	}
+	return len(a) < len(b)
+}
+func (p byPath) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+
+type repeat struct {
+	name, class string
+
+	// start and end are the one-based consensus
+	// coordinates of the aligned region and left is
+	// the length of the consensus following end.
+	start, end, left int
+}
+
+// parseRepeat parses the RepeatMasker repeat attribute of a feature on the given strand.
+// Plus strand matches are described by name, class, start, end and (left), while
+// complement matches are described by name, class, (left), end and start.
+func parseRepeat(att string, strand seq.Strand) (repeat, error) {
+	fields := strings.Fields(att)
+	if len(fields) != 5 {
+		return repeat{}, fmt.Errorf("unexpected number of repeat fields: %d", len(fields))
+	}
+	r := repeat{name: fields[0], class: fields[1]}
+	var start, end, left string
+	switch strand {
+	case seq.Plus:
+		start, end, left = fields[2], fields[3], fields[4]
+	case seq.Minus:
+		left, end, start = fields[2], fields[3], fields[4]
+	default:
+		return repeat{}, errors.New("unstranded repeat")
+	}
+	if !strings.HasPrefix(left, "(") || !strings.HasSuffix(left, ")") {
+		return repeat{}, fmt.Errorf("missing parentheses in left field: %q", left)
+	}
+	var err error
+	r.start, err = strconv.Atoi(start)
+	if err != nil {
+		return repeat{}, err
+	}
+	r.end, err = strconv.Atoi(end)
+	if err != nil {
+		return repeat{}, err
+	}
+	r.left, err = strconv.Atoi(left[1 : len(left)-1])
 	if err != nil {
-		panic(err)
+		return repeat{}, err
+	}
+	if r.start < 1 || r.end < r.start || r.left < 0 {
+		return repeat{}, fmt.Errorf("invalid consensus coordinates: start=%d end=%d left=%d", r.start, r.end, r.left)
 	}
-	return i
+	return r, nil
 }
 
 type vector []int
@@ -34,9 +214,33 @@ func (v *vector) inc(i int) {
 	}
 }
 
+// key is a repeat type and age bin pair.
+type key struct {
+	typ string
+	bin int
+}
+
+// byKey sorts keys by the class path of their repeat type and then by age bin.
+type byKey struct {
+	keys  []key
+	class map[string]string
+}
+
+func (k byKey) Len() int { return len(k.keys) }
+func (k byKey) Less(i, j int) bool {
+	a, b := k.keys[i], k.keys[j]
+	if a.typ != b.typ {
+		p := byPath{k.class[a.typ] + "/" + a.typ, k.class[b.typ] + "/" + b.typ}
+		return p.Less(0, 1)
+	}
+	return a.bin < b.bin
+}
+func (k byKey) Swap(i, j int) { k.keys[i], k.keys[j] = k.keys[j], k.keys[i] }
+
 func main() {
-	vm := make(map[string]*vector)
+	vm := make(map[key]*vector)
 	fm := make(map[string]string)
+	nodes := make(map[string]*node)
 
 	sc := featio.NewScanner(gff.NewReader(os.Stdin))
 	for sc.Next() {
@@ -48,25 +252,77 @@ func main() {
 		if att == "" {
 			continue
 		}
-		fields := strings.Fields(att)
+		rep, err := parseRepeat(att, f.FeatStrand)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "skipping %s:%d-%d: %v\n", f.SeqName, f.FeatStart, f.FeatEnd, err)
+			continue
+		}
+		class := f.Feature + "/" + rep.class + "/" + rep.name
+		if len(classes) != 0 && !classMatch(classes, class) {
+			continue
+		}
+		if tree {
+			for _, a := range ancestors(class) {
+				n, ok := nodes[a]
+				if !ok {
+					n = &node{}
+					nodes[a] = n
+				}
+				n.copies++
+				n.bases += f.Len()
+			}
+			continue
+		}
 
-		s := mustAtoi(fields[2])
-		e := mustAtoi(fields[3])
-		v, ok := vm[fields[0]]
+		var bin int
+		if age != "" {
+			a, err := ageOf(f)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "skipping %s:%d-%d: %v\n", f.SeqName, f.FeatStart, f.FeatEnd, err)
+				continue
+			}
+			bin = binOf(a, ageBins)
+		}
+
+		k := key{rep.name, bin}
+		v, ok := vm[k]
 		if !ok {
 			v = &vector{}
-			vm[fields[0]] = v
-			fm[fields[0]] = fields[1]
+			vm[k] = v
+			fm[rep.name] = rep.class
 		}
-		for i := e; i >= s; i-- {
+		for i := rep.end; i >= rep.start; i-- {
 			v.inc(i)
 		}
 	}
 
-	for typ, vec := range vm {
-		for pos, val := range *vec {
-			if val != 0 {
-				fmt.Printf("%s\t%s\t%d\t%d\n", fm[typ], typ, pos, val)
+	if tree {
+		paths := make([]string, 0, len(nodes))
+		for p := range nodes {
+			paths = append(paths, p)
+		}
+		sort.Sort(byPath(paths))
+		for _, p := range paths {
+			depth := strings.Count(p, "/")
+			fmt.Printf("%d\t%s\t%s%s\t%d\t%d\n", depth, p, strings.Repeat("  ", depth), p[strings.LastIndex(p, "/")+1:], nodes[p].copies, nodes[p].bases)
+		}
+		return
+	}
+
+	keys := make([]key, 0, len(vm))
+	for k := range vm {
+		keys = append(keys, k)
+	}
+	sort.Sort(byKey{keys, fm})
+	for _, k := range keys {
+		for pos, val := range *vm[k] {
+			if val == 0 {
+				continue
+			}
+			if age != "" {
+				fmt.Printf("%s\t%s\t%d\t%d\t%d\n", fm[k.typ], k.typ, pos, val, k.bin)
+			} else {
+				fmt.Printf("%s\t%s\t%d\t%d\n", fm[k.typ], k.typ, pos, val)
 			}
 		}
 	}
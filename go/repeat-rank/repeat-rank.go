@@ -0,0 +1,472 @@
+// Copyright ©2013 The bíogo Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// repeat-rank ranks RepeatMasker subfamilies by piRNA density and by the change in density
+// between a pair of samples.
+//
+// For each subfamily, named by the first field of the repeat attribute, the copy number and
+// total genomic length of the annotated copies are reported along with, for each sample, the
+// number of reads overlapping copies, reads per kb per million mapped reads, the number of
+// sense and antisense reads and their ratio, and the fraction of reads with a 5' U (U1) or
+// an A at position 10 (A10). The fold change in density between the second and the first
+// sample is reported as both a ratio and a log2 ratio with a pseudocount of half a read.
+//
+// Output is a TSV table sorted in descending order by the requested column.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/biogo/biogo/io/featio"
+	"github.com/biogo/biogo/io/featio/gff"
+	"github.com/biogo/biogo/seq"
+	"github.com/biogo/boom"
+	"github.com/biogo/store/interval"
+)
+
+var (
+	in,
+	names pair
+	annot,
+	out string
+	classes set
+
+	mapQ  int
+	mapQb byte
+
+	sortBy string
+)
+
+type set []string
+
+func (s *set) String() string {
+	if len(*s) == 0 {
+		return `""`
+	}
+	return strings.Join(*s, ",")
+}
+func (s *set) Set(value string) error {
+	*s = append(*s, strings.Split(value, ",")...)
+	if len(*s) == 0 {
+		return errors.New("empty set")
+	}
+	return nil
+}
+
+type pair [2]string
+
+func (p *pair) String() string {
+	return fmt.Sprintf("%q,%q", p[0], p[1])
+}
+func (p *pair) Set(value string) error {
+	c := strings.Split(value, ",")
+	switch len(c) {
+	case 0:
+		return errors.New("empty pair")
+	case 2:
+		copy((*p)[:], c)
+		return nil
+	default:
+		return fmt.Errorf("unexpected number of elements: got %d expected 2", len(c))
+	}
+}
+
+func init() {
+	names = pair{"wt", "mut"}
+	flag.Var(&in, "in", "comma separated pair of BAM files to be processed.")
+	flag.Var(&names, "names", "comma separated pair of sample names used in column headers.")
+	flag.StringVar(&annot, "annot", "", "file name of a GFF file containing repeat annotations.")
+	flag.Var(&classes, "class", "comma separated set of annotation classes to analyse (default all repeats).")
+	flag.StringVar(&out, "out", "", "outfile name (default stdout).")
+	flag.IntVar(&mapQ, "mapQ", 0, "minimum mapping quality [0, 255).")
+	flag.StringVar(&sortBy, "sort", "density", "column to sort by: copies, length, reads, density, fold or type.")
+	help := flag.Bool("help", false, "output this usage message.")
+	flag.Parse()
+	mapQb = byte(mapQ)
+	if *help {
+		flag.Usage()
+		os.Exit(0)
+	}
+	if in[0] == "" || in[1] == "" || annot == "" || mapQ < 0 || mapQ > 254 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	switch sortBy {
+	case "copies", "length", "reads", "density", "fold", "type":
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+}
+
+type intGff struct {
+	*gff.Feature
+	name string
+	uintptr
+}
+
+func (f intGff) Range() interval.IntRange { return interval.IntRange{f.Start(), f.End()} }
+func (f intGff) Overlap(b interval.IntRange) bool {
+	return f.Feature.FeatEnd > b.Start && f.Feature.FeatStart < b.End
+}
+func (f intGff) ID() uintptr { return f.uintptr }
+
+type intBam struct {
+	*boom.Record
+}
+
+func (f intBam) Range() interval.IntRange { return interval.IntRange{f.Start(), f.End()} }
+func (f intBam) Overlap(b interval.IntRange) bool {
+	return f.Start()+len(f.Seq()) > b.Start && f.Start() < b.End
+}
+func (f intBam) ID() uintptr { return 0 }
+
+// sample holds the read tallies for a subfamily in one sample.
+type sample struct {
+	reads     int
+	sense     int
+	antisense int
+	u1, a10   int
+}
+
+// family holds the annotation details and read tallies of a RepeatMasker subfamily.
+type family struct {
+	name, class string
+
+	// copies is the number of annotated copies
+	// and length is their total genomic length.
+	copies, length int
+
+	samples [2]sample
+}
+
+func annotFeats(annot string, classes, names []string) ([]interval.IntTree, map[string]*family, error) {
+	ntab := make(map[string]int, len(names))
+	for i, n := range names {
+		ntab[n] = i
+	}
+
+	ts := make([]interval.IntTree, len(names))
+
+	fams := make(map[string]*family)
+
+	f, err := os.Open(annot)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	fs := featio.NewScanner(gff.NewReader(f))
+	for id := uintptr(0); fs.Next(); id++ {
+		f := fs.Feat().(*gff.Feature)
+		att := f.FeatAttributes.Get("repeat")
+		if att == "" {
+			// Ignore non-repeat features.
+			continue
+		}
+		fields := strings.Fields(att)
+		if len(fields) < 2 {
+			continue
+		}
+		if len(classes) != 0 && !classMatch(classes, f.Feature+"/"+fields[1]+"/"+fields[0]) {
+			continue
+		}
+		chr, ok := ntab[f.SeqName]
+		if !ok {
+			continue
+		}
+		ts[chr].Insert(intGff{f, fields[0], id}, true)
+
+		fam, ok := fams[fields[0]]
+		if !ok {
+			fam = &family{name: fields[0], class: fields[1]}
+			fams[fields[0]] = fam
+		}
+		fam.copies++
+		fam.length += f.Len()
+	}
+	if err := fs.Error(); err != nil {
+		return nil, nil, err
+	}
+	for i := range ts {
+		ts[i].AdjustRanges()
+	}
+
+	return ts, fams, nil
+}
+
+// classMatch returns whether class or any of its ancestors matches a glob in classes.
+func classMatch(classes []string, class string) bool {
+	for i := 0; i <= len(class); i++ {
+		if i < len(class) && class[i] != '/' {
+			continue
+		}
+		for _, c := range classes {
+			if ok, _ := path.Match(c, class[:i]); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func checkNames(files []string) ([]string, error) {
+	var names []string
+	for _, in := range files {
+		bf, err := boom.OpenBAM(in)
+		if err != nil {
+			return nil, err
+		}
+		if names != nil {
+			for i, n := range bf.RefNames() {
+				if names[i] != n {
+					return nil, errors.New("header mismatch")
+				}
+			}
+		}
+		names = bf.RefNames()
+		bf.Close()
+	}
+	return names, nil
+}
+
+func isPrimary(r *boom.Record) bool {
+	seq := r.Seq()
+	if len(seq) < 1 {
+		return false
+	}
+	if r.Flags()&boom.Reverse == 0 {
+		return seq[0]|' ' == 't'
+	}
+	return seq[len(seq)-1]|' ' == 'a'
+}
+
+func isSecondary(r *boom.Record) bool {
+	seq := r.Seq()
+	if len(seq) < 10 {
+		return false
+	}
+	if r.Flags()&boom.Reverse == 0 {
+		return seq[9]|' ' == 'a'
+	}
+	return seq[len(seq)-10]|' ' == 't'
+}
+
+// tally adds the reads in the BAM file in to the sample i tallies of fams and
+// returns the number of mapped reads passing the mapping quality filter.
+func tally(in string, i int, feats []interval.IntTree, fams map[string]*family) (int, error) {
+	fmt.Fprintf(os.Stderr, "Reading %q\n", in)
+	bf, err := boom.OpenBAM(in)
+	if err != nil {
+		return 0, err
+	}
+	defer bf.Close()
+
+	var (
+		total int
+		hit   = make(map[string]struct{})
+	)
+	for {
+		r, _, err := bf.Read()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return 0, err
+		}
+		if r.Flags()&boom.Unmapped != 0 || r.Score() < mapQb {
+			continue
+		}
+		total++
+
+		for k := range hit {
+			delete(hit, k)
+		}
+		rs := seq.Plus
+		if r.Flags()&boom.Reverse != 0 {
+			rs = seq.Minus
+		}
+		feats[r.RefID()].DoMatching(func(iv interval.IntInterface) (done bool) {
+			f := iv.(intGff)
+			if _, ok := hit[f.name]; ok {
+				return
+			}
+			hit[f.name] = struct{}{}
+			s := &fams[f.name].samples[i]
+			s.reads++
+			switch f.FeatStrand {
+			case rs:
+				s.sense++
+			case -rs:
+				s.antisense++
+			}
+			if isPrimary(r) {
+				s.u1++
+			}
+			if isSecondary(r) {
+				s.a10++
+			}
+			return
+		}, intBam{r})
+	}
+
+	return total, nil
+}
+
+// density returns the reads per kb per million mapped reads of n reads on length bases.
+func density(n, length, total int) float64 {
+	if total == 0 || length == 0 {
+		return 0
+	}
+	return float64(n) * 1e9 / (float64(total) * float64(length))
+}
+
+// fraction returns n/d, or zero if d is zero.
+func fraction(n, d int) float64 {
+	if d == 0 {
+		return 0
+	}
+	return float64(n) / float64(d)
+}
+
+// foldChange returns the ratio of the per million read counts b and a of totals tb and ta
+// and its log2 value calculated with a pseudocount of half a read.
+func foldChange(a, b, ta, tb int) (fold, log2 float64) {
+	if ta == 0 || tb == 0 {
+		return math.NaN(), math.NaN()
+	}
+	fa := float64(a) / float64(ta)
+	fb := float64(b) / float64(tb)
+	return fb / fa, math.Log2(((float64(b) + 0.5) / float64(tb)) / ((float64(a) + 0.5) / float64(ta)))
+}
+
+// ranked is a family with its derived statistics.
+type ranked struct {
+	*family
+	density [2]float64
+	fold    float64
+	log2    float64
+}
+
+type byColumn []ranked
+
+func (r byColumn) Len() int { return len(r) }
+func (r byColumn) Less(i, j int) bool {
+	var a, b float64
+	switch sortBy {
+	case "copies":
+		a, b = float64(r[i].copies), float64(r[j].copies)
+	case "length":
+		a, b = float64(r[i].length), float64(r[j].length)
+	case "reads":
+		a, b = float64(r[i].samples[0].reads+r[i].samples[1].reads), float64(r[j].samples[0].reads+r[j].samples[1].reads)
+	case "density":
+		a, b = r[i].density[0]+r[i].density[1], r[j].density[0]+r[j].density[1]
+	case "fold":
+		// Sort by magnitude of change.
+		a, b = math.Abs(r[i].log2), math.Abs(r[j].log2)
+	case "type":
+		if r[i].class != r[j].class {
+			return r[i].class < r[j].class
+		}
+		return r[i].name < r[j].name
+	default:
+		panic("illegal sort column")
+	}
+	if a != b {
+		return a > b
+	}
+	return r[i].name < r[j].name
+}
+func (r byColumn) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+
+func main() {
+	refs, err := checkNames(in[:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	feats, fams, err := annotFeats(annot, classes, refs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	var total [2]int
+	for i, f := range in {
+		total[i], err = tally(f, i, feats, fams)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	rank := make([]ranked, 0, len(fams))
+	for _, f := range fams {
+		r := ranked{family: f}
+		for i, s := range f.samples {
+			r.density[i] = density(s.reads, f.length, total[i])
+		}
+		r.fold, r.log2 = foldChange(f.samples[0].reads, f.samples[1].reads, total[0], total[1])
+		rank = append(rank, r)
+	}
+	sort.Sort(byColumn(rank))
+
+	var w io.Writer = os.Stdout
+	if out != "" {
+		f, err := os.Create(out)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		w = f
+	}
+	err = writeTSV(w, rank, total)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func writeTSV(w io.Writer, rank []ranked, total [2]int) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprint(bw, "class\ttype\tcopies\tlength")
+	for _, n := range names {
+		fmt.Fprintf(bw, "\t%[1]s-reads\t%[1]s-rpkm\t%[1]s-sense\t%[1]s-antisense\t%[1]s-sense-ratio\t%[1]s-U1\t%[1]s-A10", n)
+	}
+	_, err := fmt.Fprintln(bw, "\tfold-change\tlog2-fold-change")
+	if err != nil {
+		return err
+	}
+	for _, r := range rank {
+		fmt.Fprintf(bw, "%s\t%s\t%d\t%d", r.class, r.name, r.copies, r.length)
+		for i, s := range r.samples {
+			ratio := math.NaN()
+			if s.antisense != 0 {
+				ratio = float64(s.sense) / float64(s.antisense)
+			} else if s.sense != 0 {
+				ratio = math.Inf(1)
+			}
+			fmt.Fprintf(bw, "\t%d\t%g\t%d\t%d\t%g\t%g\t%g",
+				s.reads, r.density[i], s.sense, s.antisense, ratio,
+				fraction(s.u1, s.reads), fraction(s.a10, s.reads),
+			)
+		}
+		_, err = fmt.Fprintf(bw, "\t%g\t%g\n", r.fold, r.log2)
+		if err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
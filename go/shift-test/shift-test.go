@@ -0,0 +1,593 @@
+// Copyright ©2013 The bíogo Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// shift-test performs statistical comparisons of the end offset distributions written
+// by overlap-end.
+//
+// Two comparisons are available:
+//
+//   - groups: the offsets of one end are compared between two overlap-end csv files,
+//     nominally wild-type and mutant; and
+//   - ends: the 5' and 3' end offsets within a single overlap-end csv file are compared.
+//
+// Offset distributions are pooled across all replicate pairs present in a csv file and
+// compared with Welch's t-test and the Wilcoxon rank sum test, reporting the difference in
+// means with its confidence interval and Cohen's d, and the Hodges-Lehmann shift estimate with
+// its confidence interval and the rank-biserial correlation. In the groups comparison the
+// per-pair mean offsets are also compared with Welch's t-test to give a replicate level test.
+//
+// Columns are identified by the csv header rather than by position, so changes to the
+// offset range of overlap-end do not affect the analysis. When the csv files have a Class
+// column, as written by overlap-end with -annot, rows are pooled and tested separately for
+// each annotation class.
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	a, b string
+	out  string
+
+	compare string
+	end     string
+
+	minOffset int
+	maxOffset int
+
+	level float64
+)
+
+func init() {
+	flag.StringVar(&a, "a", "", "overlap-end csv file for the first group (nominally wild-type).")
+	flag.StringVar(&b, "b", "", "overlap-end csv file for the second group (nominally mutant).")
+	flag.StringVar(&out, "out", "", "outfile name for the results table (default stdout).")
+	flag.StringVar(&compare, "compare", "groups", "comparison to perform: groups - between a and b, ends - 5' against 3' in a.")
+	flag.StringVar(&end, "end", "three", "end offsets to compare between groups: five or three.")
+	flag.IntVar(&minOffset, "min", -10, "minimum offset considered.")
+	flag.IntVar(&maxOffset, "max", 0, "maximum offset considered.")
+	flag.Float64Var(&level, "level", 0.95, "confidence level for intervals.")
+	help := flag.Bool("help", false, "output this usage message.")
+	flag.Parse()
+	if *help {
+		flag.Usage()
+		os.Exit(0)
+	}
+	if a == "" || minOffset > maxOffset || level <= 0 || level >= 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	switch compare {
+	case "groups":
+		if b == "" {
+			flag.Usage()
+			os.Exit(1)
+		}
+	case "ends":
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+	switch end {
+	case "five", "three":
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+}
+
+const (
+	fivePrime  = "FivePrime"
+	threePrime = "ThreePrime"
+)
+
+// row is a single overlap-end offset distribution.
+type row struct {
+	end         string
+	class       string
+	long, short string
+	counts      map[int]float64
+}
+
+// readCSV reads the offset distributions from an overlap-end csv file.
+func readCSV(file string) ([]row, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	header, err := r.Read()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		endCol   = -1
+		classCol = -1
+		longCol  = -1
+		shortCol = -1
+		offsets  = make(map[int]int)
+	)
+	for i, h := range header {
+		switch h {
+		case "End":
+			endCol = i
+		case "Class":
+			classCol = i
+		case "Long":
+			longCol = i
+		case "Short":
+			shortCol = i
+		default:
+			if o, err := strconv.Atoi(h); err == nil {
+				offsets[i] = o
+			}
+		}
+	}
+	if endCol < 0 || longCol < 0 || shortCol < 0 || len(offsets) == 0 {
+		return nil, fmt.Errorf("%s: not an overlap-end csv file", file)
+	}
+
+	var rows []row
+	for {
+		rec, err := r.Read()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		e := row{end: rec[endCol], long: rec[longCol], short: rec[shortCol], counts: make(map[int]float64)}
+		if classCol >= 0 {
+			e.class = rec[classCol]
+		}
+		for i, o := range offsets {
+			v, err := strconv.ParseFloat(rec[i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", file, err)
+			}
+			e.counts[o] = v
+		}
+		rows = append(rows, e)
+	}
+	return rows, nil
+}
+
+// dist is a weighted distribution of integer offsets.
+type dist map[int]float64
+
+// classes returns the sorted set of classes in rows.
+func classes(rows []row) []string {
+	seen := make(map[string]bool)
+	var c []string
+	for _, r := range rows {
+		if !seen[r.class] {
+			seen[r.class] = true
+			c = append(c, r.class)
+		}
+	}
+	sort.Strings(c)
+	return c
+}
+
+// pool returns the pooled distribution of rows with the given end and class within the
+// offset range.
+func pool(rows []row, end, class string) dist {
+	d := make(dist)
+	for _, r := range rows {
+		if r.end != end || r.class != class {
+			continue
+		}
+		for o, v := range r.counts {
+			if minOffset <= o && o <= maxOffset && v > 0 {
+				d[o] += v
+			}
+		}
+	}
+	return d
+}
+
+// perPair returns the mean offset of each row with the given end and class within the
+// offset range.
+func perPair(rows []row, end, class string) []float64 {
+	var means []float64
+	for _, r := range rows {
+		if r.end != end || r.class != class {
+			continue
+		}
+		d := make(dist)
+		for o, v := range r.counts {
+			if minOffset <= o && o <= maxOffset && v > 0 {
+				d[o] += v
+			}
+		}
+		if n, m, _ := d.moments(); n > 0 {
+			means = append(means, m)
+		}
+	}
+	return means
+}
+
+func (d dist) levels() []int {
+	l := make([]int, 0, len(d))
+	for o := range d {
+		l = append(l, o)
+	}
+	sort.Ints(l)
+	return l
+}
+
+// moments returns the total weight, mean and sample variance of d.
+func (d dist) moments() (n, mean, variance float64) {
+	for o, w := range d {
+		n += w
+		mean += float64(o) * w
+	}
+	if n == 0 {
+		return 0, math.NaN(), math.NaN()
+	}
+	mean /= n
+	for o, w := range d {
+		dx := float64(o) - mean
+		variance += dx * dx * w
+	}
+	return n, mean, variance / (n - 1)
+}
+
+func valuesDist(v []float64) (n, mean, variance float64) {
+	for _, x := range v {
+		n++
+		mean += x
+	}
+	if n == 0 {
+		return 0, math.NaN(), math.NaN()
+	}
+	mean /= n
+	for _, x := range v {
+		variance += (x - mean) * (x - mean)
+	}
+	return n, mean, variance / (n - 1)
+}
+
+// result is a single line of the results table.
+type result struct {
+	comparison string
+	class      string
+	test       string
+
+	n    [2]float64
+	mean [2]float64
+
+	estimate float64
+	ci       [2]float64
+
+	statistic float64
+	p         float64
+
+	effectName string
+	effect     float64
+}
+
+// welch performs Welch's t-test on two samples described by their moments.
+func welch(comparison, class, test string, n1, m1, v1, n2, m2, v2 float64) result {
+	res := result{
+		comparison: comparison,
+		class:      class,
+		test:       test,
+		n:          [2]float64{n1, n2},
+		mean:       [2]float64{m1, m2},
+		estimate:   m1 - m2,
+		effectName: "cohen-d",
+	}
+	se2 := v1/n1 + v2/n2
+	se := math.Sqrt(se2)
+	df := se2 * se2 / ((v1/n1)*(v1/n1)/(n1-1) + (v2/n2)*(v2/n2)/(n2-1))
+	res.statistic = res.estimate / se
+	res.p = 2 * studentTUpper(math.Abs(res.statistic), df)
+	q := studentTQuantile(1-(1-level)/2, df)
+	res.ci = [2]float64{res.estimate - q*se, res.estimate + q*se}
+	res.effect = res.estimate / math.Sqrt(((n1-1)*v1+(n2-1)*v2)/(n1+n2-2))
+	return res
+}
+
+// wilcoxon performs the Wilcoxon rank sum test with normal approximation, tie and continuity
+// correction, returning the Hodges-Lehmann shift estimate and its confidence interval.
+func wilcoxon(comparison, class string, x, y dist) result {
+	n1, m1, _ := x.moments()
+	n2, m2, _ := y.moments()
+	res := result{
+		comparison: comparison,
+		class:      class,
+		test:       "wilcoxon",
+		n:          [2]float64{n1, n2},
+		mean:       [2]float64{m1, m2},
+		effectName: "rank-biserial",
+	}
+
+	// Mid-ranks of the pooled offset levels.
+	all := make(dist)
+	for o, w := range x {
+		all[o] += w
+	}
+	for o, w := range y {
+		all[o] += w
+	}
+	var (
+		rank float64
+		ties float64
+		rx   float64
+	)
+	for _, o := range all.levels() {
+		t := all[o]
+		mid := rank + (t+1)/2
+		rx += mid * x[o]
+		ties += t*t*t - t
+		rank += t
+	}
+	N := n1 + n2
+	u := rx - n1*(n1+1)/2
+	mu := n1 * n2 / 2
+	sigma := math.Sqrt(n1 * n2 / 12 * ((N + 1) - ties/(N*(N-1))))
+	corr := 0.5
+	if u < mu {
+		corr = -0.5
+	}
+	res.statistic = (u - mu - corr) / sigma
+	res.p = math.Erfc(math.Abs(res.statistic) / math.Sqrt2)
+	res.effect = 2*u/(n1*n2) - 1
+
+	// Hodges-Lehmann estimate and Moses confidence interval from the
+	// weighted distribution of pairwise differences.
+	diffs := make(dist)
+	for ox, wx := range x {
+		for oy, wy := range y {
+			diffs[ox-oy] += wx * wy
+		}
+	}
+	total := n1 * n2
+	z := normalQuantile(1 - (1-level)/2)
+	k := math.Floor(mu - z*sigma)
+	if k < 1 {
+		k = 1
+	}
+	res.estimate = diffs.orderStat((total + 1) / 2)
+	res.ci = [2]float64{diffs.orderStat(k), diffs.orderStat(total - k + 1)}
+	return res
+}
+
+// orderStat returns the kth smallest value in d, with k counted from one.
+func (d dist) orderStat(k float64) float64 {
+	var cum float64
+	l := d.levels()
+	for _, o := range l {
+		cum += d[o]
+		if cum >= k {
+			return float64(o)
+		}
+	}
+	return float64(l[len(l)-1])
+}
+
+func main() {
+	rowsA, err := readCSV(a)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	var results []result
+	switch compare {
+	case "groups":
+		rowsB, err := readCSV(b)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		e := threePrime
+		if end == "five" {
+			e = fivePrime
+		}
+		comparison := fmt.Sprintf("%s %s-%s", end, a, b)
+		for _, class := range classes(rowsA) {
+			x, y := pool(rowsA, e, class), pool(rowsB, e, class)
+			if len(x) == 0 || len(y) == 0 {
+				continue
+			}
+			n1, m1, v1 := x.moments()
+			n2, m2, v2 := y.moments()
+			results = append(results, welch(comparison, class, "welch-t", n1, m1, v1, n2, m2, v2))
+			results = append(results, wilcoxon(comparison, class, x, y))
+
+			pa, pb := perPair(rowsA, e, class), perPair(rowsB, e, class)
+			if len(pa) > 1 && len(pb) > 1 {
+				n1, m1, v1 := valuesDist(pa)
+				n2, m2, v2 := valuesDist(pb)
+				results = append(results, welch(comparison, class, "welch-t-pairs", n1, m1, v1, n2, m2, v2))
+			}
+		}
+	case "ends":
+		comparison := fmt.Sprintf("five-three %s", a)
+		for _, class := range classes(rowsA) {
+			x, y := pool(rowsA, fivePrime, class), pool(rowsA, threePrime, class)
+			if len(x) == 0 || len(y) == 0 {
+				continue
+			}
+			n1, m1, v1 := x.moments()
+			n2, m2, v2 := y.moments()
+			results = append(results, welch(comparison, class, "welch-t", n1, m1, v1, n2, m2, v2))
+			results = append(results, wilcoxon(comparison, class, x, y))
+		}
+	}
+	if len(results) == 0 {
+		fmt.Fprintln(os.Stderr, errors.New("no data"))
+		os.Exit(1)
+	}
+
+	w := os.Stdout
+	if out != "" {
+		f, err := os.Create(out)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		w = f
+	}
+	err = writeTable(w, results)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// writeTable writes results to w, including a Class column if any result has a class.
+func writeTable(w io.Writer, results []result) error {
+	var byClass bool
+	for _, r := range results {
+		if r.class != "" {
+			byClass = true
+			break
+		}
+	}
+	header := []string{"Comparison", "Test", "N1", "N2", "Mean1", "Mean2", "Estimate", "Lower", "Upper", "Statistic", "P", "Effect", "EffectSize"}
+	if byClass {
+		header = append(header[:1], append([]string{"Class"}, header[1:]...)...)
+	}
+	_, err := fmt.Fprintln(w, strings.Join(header, "\t"))
+	if err != nil {
+		return err
+	}
+	for _, r := range results {
+		comparison := r.comparison
+		if byClass {
+			comparison += "\t" + r.class
+		}
+		_, err = fmt.Fprintf(w, "%s\t%s\t%g\t%g\t%g\t%g\t%g\t%g\t%g\t%g\t%g\t%s\t%g\n",
+			comparison, r.test,
+			r.n[0], r.n[1],
+			r.mean[0], r.mean[1],
+			r.estimate, r.ci[0], r.ci[1],
+			r.statistic, r.p,
+			r.effectName, r.effect,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// studentTUpper returns the upper tail probability of Student's t distribution with df
+// degrees of freedom at t >= 0.
+func studentTUpper(t, df float64) float64 {
+	return 0.5 * regIncBeta(df/2, 0.5, df/(df+t*t))
+}
+
+// studentTQuantile returns the p quantile of Student's t distribution with df degrees of
+// freedom for p > 0.5.
+func studentTQuantile(p, df float64) float64 {
+	lo, hi := 0., 1.
+	for studentTUpper(hi, df) > 1-p {
+		hi *= 2
+	}
+	for i := 0; i < 100; i++ {
+		mid := (lo + hi) / 2
+		if studentTUpper(mid, df) > 1-p {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return (lo + hi) / 2
+}
+
+// normalQuantile returns the p quantile of the standard normal distribution for p > 0.5.
+func normalQuantile(p float64) float64 {
+	lo, hi := 0., 40.
+	for i := 0; i < 100; i++ {
+		mid := (lo + hi) / 2
+		if 0.5*math.Erfc(mid/math.Sqrt2) > 1-p {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return (lo + hi) / 2
+}
+
+// regIncBeta returns the regularised incomplete beta function I_x(a, b).
+func regIncBeta(a, b, x float64) float64 {
+	if x <= 0 {
+		return 0
+	}
+	if x >= 1 {
+		return 1
+	}
+	la, _ := math.Lgamma(a)
+	lb, _ := math.Lgamma(b)
+	lab, _ := math.Lgamma(a + b)
+	front := math.Exp(lab - la - lb + a*math.Log(x) + b*math.Log1p(-x))
+	if x < (a+1)/(a+b+2) {
+		return front * betaCF(a, b, x) / a
+	}
+	return 1 - front*betaCF(b, a, 1-x)/b
+}
+
+// betaCF evaluates the continued fraction for the incomplete beta function by the
+// modified Lentz method.
+func betaCF(a, b, x float64) float64 {
+	const (
+		maxIter = 300
+		eps     = 1e-14
+		tiny    = 1e-300
+	)
+	qab, qap, qam := a+b, a+1, a-1
+	c, d := 1., 1-qab*x/qap
+	if math.Abs(d) < tiny {
+		d = tiny
+	}
+	d = 1 / d
+	h := d
+	for m := 1.; m <= maxIter; m++ {
+		m2 := 2 * m
+		aa := m * (b - m) * x / ((qam + m2) * (a + m2))
+		d = 1 + aa*d
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = 1 + aa/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		h *= d * c
+		aa = -(a + m) * (qab + m) * x / ((a + m2) * (qap + m2))
+		d = 1 + aa*d
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = 1 + aa/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		del := d * c
+		h *= del
+		if math.Abs(del-1) < eps {
+			break
+		}
+	}
+	return h
+}
@@ -0,0 +1,450 @@
+// Copyright ©2013 The bíogo Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// slicer-signature tests for piRNA guided target cleavage in long RNA-seq or degradome data.
+//
+// PIWI proteins cleave targets between the nucleotides paired with positions 10 and 11 of the
+// guide piRNA, so the 5' end of the 3' cleavage product lies on the strand opposite the piRNA
+// with the two 5' ends overlapping by 10 nt. For each overlap length from 1 to the maximum
+// overlap, the number of piRNA and target 5' end pairs, weighted by read counts, is tallied.
+// The slicer signature is reported as the z-score of the 10 nt overlap count against the
+// counts at the other overlaps.
+//
+// Pairs are assigned to the repeat subfamilies and genes of an optional GFF annotation that
+// overlap the target 5' end and a z-score is reported for each, in addition to the total over
+// all pairs.
+//
+// Target 5' ends are taken from the first mate of forward stranded libraries, such as
+// degradome libraries, and from the second mate of reverse stranded libraries, such as dUTP
+// first-strand RNA-seq libraries. Unpaired reads from reverse stranded libraries are assigned
+// to the opposite strand, so their 5' ends are those of the RNA only when reads span the
+// whole fragment.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/biogo/biogo/io/featio"
+	"github.com/biogo/biogo/io/featio/gff"
+	"github.com/biogo/boom"
+	"github.com/biogo/store/interval"
+)
+
+const slice = 10
+
+var (
+	small,
+	target set
+	annot,
+	out string
+	classes set
+
+	geneFeature string
+	id          string
+	library     string
+
+	maxOverlap int
+	minPairs   float64
+
+	mapQ  int
+	mapQb byte
+)
+
+type set []string
+
+func (s *set) String() string {
+	if len(*s) == 0 {
+		return `""`
+	}
+	return strings.Join(*s, ",")
+}
+func (s *set) Set(value string) error {
+	*s = append(*s, strings.Split(value, ",")...)
+	if len(*s) == 0 {
+		return errors.New("empty set")
+	}
+	return nil
+}
+
+func init() {
+	flag.Var(&small, "small", "comma separated set of small RNA BAM files to be processed.")
+	flag.Var(&target, "target", "comma separated set of long RNA-seq or degradome BAM files to be processed.")
+	flag.StringVar(&annot, "annot", "", "file name of a GFF file containing repeat and gene annotations.")
+	flag.Var(&classes, "class", "comma separated set of annotation class globs to report (default all).")
+	flag.StringVar(&geneFeature, "gene", "gene", "GFF feature type of genes.")
+	flag.StringVar(&id, "id", "gene_id", "GFF attribute naming genes.")
+	flag.StringVar(&library, "library", "forward", "target library strandedness: forward - read 1 is sense, reverse - read 1 is antisense.")
+	flag.StringVar(&out, "out", "", "outfile name (default stdout).")
+	flag.IntVar(&maxOverlap, "max", 20, "maximum 5' end overlap considered.")
+	flag.Float64Var(&minPairs, "min", 1, "minimum total pairs for a family or gene to be reported.")
+	flag.IntVar(&mapQ, "mapQ", 0, "minimum mapping quality [0, 255).")
+	help := flag.Bool("help", false, "output this usage message.")
+	flag.Parse()
+	mapQb = byte(mapQ)
+	if *help {
+		flag.Usage()
+		os.Exit(0)
+	}
+	if len(small) == 0 || len(target) == 0 || maxOverlap < slice+2 || mapQ < 0 || mapQ > 254 || (library != "forward" && library != "reverse") {
+		flag.Usage()
+		os.Exit(1)
+	}
+}
+
+// end is a stranded 5' end position.
+type end struct {
+	ref     int
+	pos     int
+	reverse bool
+}
+
+// fivePrimeEnds returns the counts of RNA 5' ends in the BAM files in files. If reverse
+// is false only the first mate of paired alignments is counted, otherwise only the second
+// mate is counted and unpaired alignments are assigned to the opposite strand.
+func fivePrimeEnds(files []string, reverse bool) (map[end]float64, error) {
+	ends := make(map[end]float64)
+	for _, in := range files {
+		fmt.Fprintf(os.Stderr, "Reading %q\n", in)
+		bf, err := boom.OpenBAM(in)
+		if err != nil {
+			return nil, err
+		}
+		for {
+			r, _, err := bf.Read()
+			if err != nil {
+				if err == io.EOF {
+					break
+				}
+				bf.Close()
+				return nil, err
+			}
+			flags := r.Flags()
+			if flags&(boom.Unmapped|boom.Secondary) != 0 || r.Score() < mapQb {
+				continue
+			}
+			mate := boom.Read1
+			if reverse {
+				mate = boom.Read2
+			}
+			paired := flags&boom.Paired != 0
+			if paired && flags&mate == 0 {
+				continue
+			}
+			e := end{ref: r.RefID(), reverse: flags&boom.Reverse != 0}
+			if reverse && !paired {
+				e.reverse = !e.reverse
+			}
+			if e.reverse {
+				e.pos = r.End() - 1
+			} else {
+				e.pos = r.Start()
+			}
+			ends[e]++
+		}
+		bf.Close()
+	}
+	return ends, nil
+}
+
+// partner returns the target 5' end on the opposite strand that overlaps
+// the piRNA 5' end p by the given number of bases.
+func partner(p end, overlap int) end {
+	if p.reverse {
+		return end{ref: p.ref, pos: p.pos - (overlap - 1), reverse: false}
+	}
+	return end{ref: p.ref, pos: p.pos + (overlap - 1), reverse: true}
+}
+
+// group holds the overlap tallies of a repeat subfamily, a gene or all pairs.
+type group struct {
+	kind, class, name string
+
+	// counts holds the weighted number of
+	// pairs for each overlap length.
+	counts []float64
+}
+
+func newGroup(kind, class, name string) *group {
+	return &group{kind: kind, class: class, name: name, counts: make([]float64, maxOverlap+1)}
+}
+
+// zScore returns the z-score of the slice overlap count against the counts
+// at the other overlaps, and the mean and standard deviation of those counts.
+func (g *group) zScore() (z, mean, sd float64) {
+	var n float64
+	for o := 1; o <= maxOverlap; o++ {
+		if o == slice {
+			continue
+		}
+		mean += g.counts[o]
+		n++
+	}
+	mean /= n
+	for o := 1; o <= maxOverlap; o++ {
+		if o == slice {
+			continue
+		}
+		d := g.counts[o] - mean
+		sd += d * d
+	}
+	sd = math.Sqrt(sd / (n - 1))
+	if sd == 0 {
+		return math.NaN(), mean, sd
+	}
+	return (g.counts[slice] - mean) / sd, mean, sd
+}
+
+func (g *group) total() float64 {
+	var t float64
+	for _, c := range g.counts[1:] {
+		t += c
+	}
+	return t
+}
+
+type intGff struct {
+	*gff.Feature
+	group *group
+	uintptr
+}
+
+func (f intGff) Range() interval.IntRange { return interval.IntRange{f.Start(), f.End()} }
+func (f intGff) Overlap(b interval.IntRange) bool {
+	return f.Feature.FeatEnd > b.Start && f.Feature.FeatStart < b.End
+}
+func (f intGff) ID() uintptr { return f.uintptr }
+
+// point is a single base query interval.
+type point int
+
+func (p point) Range() interval.IntRange { return interval.IntRange{int(p), int(p) + 1} }
+func (p point) Overlap(b interval.IntRange) bool {
+	return int(p)+1 > b.Start && int(p) < b.End
+}
+func (p point) ID() uintptr { return 0 }
+
+// annotGroups returns interval trees of repeat and gene features and their groups.
+func annotGroups(annot string, classes, names []string) ([]interval.IntTree, map[string]*group, error) {
+	ntab := make(map[string]int, len(names))
+	for i, n := range names {
+		ntab[n] = i
+	}
+
+	ts := make([]interval.IntTree, len(names))
+
+	groups := make(map[string]*group)
+
+	f, err := os.Open(annot)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	fs := featio.NewScanner(gff.NewReader(f))
+	for uid := uintptr(0); fs.Next(); uid++ {
+		f := fs.Feat().(*gff.Feature)
+		var kind, class, name string
+		if att := f.FeatAttributes.Get("repeat"); att != "" {
+			fields := strings.Fields(att)
+			if len(fields) < 2 {
+				continue
+			}
+			kind, class, name = "family", f.Feature+"/"+fields[1], fields[0]
+		} else if f.Feature == geneFeature {
+			name = strings.Trim(f.FeatAttributes.Get(id), `"`)
+			if name == "" {
+				continue
+			}
+			kind, class = "gene", f.Feature
+		} else {
+			continue
+		}
+		if len(classes) != 0 && !classMatch(classes, class+"/"+name) {
+			continue
+		}
+		chr, ok := ntab[f.SeqName]
+		if !ok {
+			continue
+		}
+		key := kind + "\t" + name
+		g, ok := groups[key]
+		if !ok {
+			g = newGroup(kind, class, name)
+			groups[key] = g
+		}
+		ts[chr].Insert(intGff{f, g, uid}, true)
+	}
+	if err := fs.Error(); err != nil {
+		return nil, nil, err
+	}
+	for i := range ts {
+		ts[i].AdjustRanges()
+	}
+
+	return ts, groups, nil
+}
+
+// classMatch returns whether class or any of its ancestors matches a glob in classes.
+func classMatch(classes []string, class string) bool {
+	for i := 0; i <= len(class); i++ {
+		if i < len(class) && class[i] != '/' {
+			continue
+		}
+		for _, c := range classes {
+			if ok, _ := path.Match(c, class[:i]); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func checkNames(files []string) ([]string, error) {
+	var names []string
+	for _, in := range files {
+		bf, err := boom.OpenBAM(in)
+		if err != nil {
+			return nil, err
+		}
+		if names != nil {
+			for i, n := range bf.RefNames() {
+				if names[i] != n {
+					return nil, errors.New("header mismatch")
+				}
+			}
+		}
+		names = bf.RefNames()
+		bf.Close()
+	}
+	return names, nil
+}
+
+func main() {
+	refs, err := checkNames(append(append([]string(nil), small...), target...))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	var (
+		feats  []interval.IntTree
+		groups map[string]*group
+	)
+	if annot != "" {
+		feats, groups, err = annotGroups(annot, classes, refs)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	piRNAs, err := fivePrimeEnds(small, false)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	targets, err := fivePrimeEnds(target, library == "reverse")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	all := newGroup("all", "", "")
+	var hit []*group
+	for p, pc := range piRNAs {
+		for o := 1; o <= maxOverlap; o++ {
+			t := partner(p, o)
+			tc, ok := targets[t]
+			if !ok {
+				continue
+			}
+			pairs := pc * tc
+			all.counts[o] += pairs
+			if feats == nil {
+				continue
+			}
+			hit = hit[:0]
+			feats[t.ref].DoMatching(func(iv interval.IntInterface) (done bool) {
+				g := iv.(intGff).group
+				for _, h := range hit {
+					if h == g {
+						return
+					}
+				}
+				hit = append(hit, g)
+				g.counts[o] += pairs
+				return
+			}, point(t.pos))
+		}
+	}
+
+	sorted := []*group{all}
+	for _, g := range groups {
+		if g.total() >= minPairs {
+			sorted = append(sorted, g)
+		}
+	}
+	sort.Sort(byZ(sorted[1:]))
+
+	var w io.Writer = os.Stdout
+	if out != "" {
+		f, err := os.Create(out)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		w = f
+	}
+	err = writeTSV(w, sorted)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+type byZ []*group
+
+func (g byZ) Len() int { return len(g) }
+func (g byZ) Less(i, j int) bool {
+	zi, _, _ := g[i].zScore()
+	zj, _, _ := g[j].zScore()
+	if math.IsNaN(zj) {
+		return !math.IsNaN(zi)
+	}
+	return zi > zj
+}
+func (g byZ) Swap(i, j int) { g[i], g[j] = g[j], g[i] }
+
+func writeTSV(w io.Writer, groups []*group) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprint(bw, "kind\tclass\tname\tpairs\tpairs-10\tbackground-mean\tbackground-sd\tz-score")
+	for o := 1; o <= maxOverlap; o++ {
+		fmt.Fprintf(bw, "\toverlap-%d", o)
+	}
+	_, err := fmt.Fprintln(bw)
+	if err != nil {
+		return err
+	}
+	for _, g := range groups {
+		z, mean, sd := g.zScore()
+		fmt.Fprintf(bw, "%s\t%s\t%s\t%g\t%g\t%g\t%g\t%g", g.kind, g.class, g.name, g.total(), g.counts[slice], mean, sd, z)
+		for _, c := range g.counts[1:] {
+			fmt.Fprintf(bw, "\t%g", c)
+		}
+		_, err = fmt.Fprintln(bw)
+		if err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
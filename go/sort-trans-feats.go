@@ -5,12 +5,16 @@
 package main
 
 import (
+	"bufio"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"math"
 	"os"
+	"path"
 	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/biogo/biogo/feat/genome/mouse/mm10"
@@ -24,6 +28,10 @@ var (
 	annot string
 	reads,
 	classes set
+
+	age      string
+	ageBins  []float64
+	ageTable string
 )
 
 type set []string
@@ -46,6 +54,9 @@ func init() {
 	flag.Var(&reads, "reads", "comma separated set of BAM file to be processed.")
 	flag.StringVar(&annot, "annot", "", "file name of a GFF file containing annotations.")
 	flag.Var(&classes, "class", "comma separated set of annotation classes to analyse.")
+	flag.StringVar(&age, "age", "", "repeat age measure used to stratify copies: score - GFF score, or the name of a\n\tGFF attribute holding RepeatMasker divergence. Empty disables stratification.")
+	bins := flag.String("bins", "5,10,15,20,25", "comma separated ascending age bin boundaries.")
+	flag.StringVar(&ageTable, "agetable", "", "file name to write the age stratified repeat type densities to.")
 	help := flag.Bool("help", false, "output this usage message.")
 	flag.Parse()
 	if *help {
@@ -56,6 +67,18 @@ func init() {
 		flag.Usage()
 		os.Exit(1)
 	}
+	if ageTable != "" && age == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if age != "" {
+		var err error
+		ageBins, err = parseBins(*bins)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
 }
 
 var index = map[string]int{}
@@ -75,6 +98,16 @@ func min(a, b int) int {
 
 type intGff struct {
 	*gff.Feature
+
+	// name, class and bin are the repeat type, class
+	// and age bin of the feature when age is not empty.
+	name, class string
+	bin         int
+
+	// bases is the number of read bases
+	// overlapping the feature.
+	bases *int
+
 	uintptr
 }
 
@@ -84,56 +117,207 @@ func (f intGff) Overlap(b interval.IntRange) bool {
 }
 func (f intGff) ID() uintptr { return f.uintptr }
 
-func annotFeats(annot string, classes, names []string) ([]interval.IntTree, error) {
+// ageKey is a repeat type and age bin pair.
+type ageKey struct {
+	name string
+	bin  int
+}
+
+// ageSummary holds the age stratified density of a repeat type.
+type ageSummary struct {
+	class string
+
+	// copies is the number of annotated copies
+	// and expressed is the number of copies
+	// overlapped by at least one read.
+	copies, expressed int
+
+	// density is the sum of the
+	// normalised copy densities.
+	density float64
+}
+
+func annotFeats(annot string, classes, names []string) ([]interval.IntTree, map[ageKey]*ageSummary, error) {
 	ntab := make(map[string]int, len(names))
 	for i, n := range names {
 		ntab[n] = i
 	}
 
 	ts := make([]interval.IntTree, len(names))
-
-	cm := make(map[string]struct{})
-	for _, c := range classes {
-		cm[c] = struct{}{}
-	}
+	ages := make(map[ageKey]*ageSummary)
 
 	f, err := os.Open(annot)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	fs := featio.NewScanner(gff.NewReader(f))
 	for id := uintptr(0); fs.Next(); id++ {
 		f := fs.Feat().(*gff.Feature)
-		var class string
+		var class, name string
 		if att := f.FeatAttributes.Get(f.Feature); att != "" {
 			// This gets the repeat attributes only.
-			class = f.Feature + "/" + strings.Fields(att)[1]
+			fields := strings.Fields(att)
+			class = f.Feature + "/" + fields[1]
+			name = fields[0]
 		} else {
 			class = f.Feature
+			name = f.Feature
 		}
-		if _, ok := cm[class]; !ok {
-			last := strings.LastIndex(class, "/")
-			if last == strings.Index(class, "/") {
-				continue
-			}
-			if _, ok := cm[class[:last]]; !ok {
+		if !classMatch(classes, class+"/"+name) {
+			continue
+		}
+		var bin int
+		if age != "" {
+			a, err := ageOf(f)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "skipping %s:%d-%d: %v\n", f.SeqName, f.FeatStart, f.FeatEnd, err)
 				continue
 			}
+			bin = binOf(a, ageBins)
 		}
 		if chr, ok := ntab[f.SeqName]; ok {
-			ts[chr].Insert(intGff{f, id}, true)
+			ts[chr].Insert(intGff{f, name, class, bin, new(int), id}, true)
+			if age != "" {
+				k := ageKey{name, bin}
+				s, ok := ages[k]
+				if !ok {
+					s = &ageSummary{class: class}
+					ages[k] = s
+				}
+				s.copies++
+			}
 		}
 	}
 	if err := fs.Error(); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	for i := range ts {
 		ts[i].AdjustRanges()
 	}
 
-	return ts, nil
+	return ts, ages, nil
+}
+
+// classMatch returns whether class or any of its ancestors matches a glob in classes.
+func classMatch(classes []string, class string) bool {
+	for i := 0; i <= len(class); i++ {
+		if i < len(class) && class[i] != '/' {
+			continue
+		}
+		for _, c := range classes {
+			if ok, _ := path.Match(c, class[:i]); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseBins returns the ascending bin boundaries described by the comma separated list in s.
+func parseBins(s string) ([]float64, error) {
+	var b []float64
+	for _, f := range strings.Split(s, ",") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil {
+			return nil, err
+		}
+		if len(b) != 0 && v <= b[len(b)-1] {
+			return nil, fmt.Errorf("age bins not ascending: %s", s)
+		}
+		b = append(b, v)
+	}
+	return b, nil
+}
+
+// ageOf returns the age measure of f, either the GFF score or the value
+// of the attribute named by age.
+func ageOf(f *gff.Feature) (float64, error) {
+	if age == "score" {
+		if f.FeatScore == nil {
+			return 0, errors.New("missing score")
+		}
+		return *f.FeatScore, nil
+	}
+	att := strings.Trim(f.FeatAttributes.Get(age), `"`)
+	if att == "" {
+		return 0, fmt.Errorf("missing %s attribute", age)
+	}
+	return strconv.ParseFloat(att, 64)
+}
+
+// binOf returns the index of the bin holding v given the bin boundaries in edges.
+// Bin i holds values in [edges[i-1], edges[i]).
+func binOf(v float64, edges []float64) int {
+	return sort.Search(len(edges), func(i int) bool { return v < edges[i] })
+}
+
+// binBounds returns the lower and upper bounds of bin i for the boundaries in edges.
+func binBounds(i int, edges []float64) (lower, upper float64) {
+	lower, upper = math.Inf(-1), math.Inf(1)
+	if i > 0 {
+		lower = edges[i-1]
+	}
+	if i < len(edges) {
+		upper = edges[i]
+	}
+	return lower, upper
+}
+
+// writeAgeTable writes the per age bin density of each repeat type in ages to the named file.
+func writeAgeTable(path string, ages map[ageKey]*ageSummary) error {
+	keys := make([]ageKey, 0, len(ages))
+	for k := range ages {
+		keys = append(keys, k)
+	}
+	sort.Sort(byAge{keys, ages})
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	_, err = fmt.Fprintln(w, "class\ttype\tbin\tlower\tupper\tcopies\texpressed\tmean-density")
+	if err != nil {
+		f.Close()
+		return err
+	}
+	for _, k := range keys {
+		s := ages[k]
+		lower, upper := binBounds(k.bin, ageBins)
+		_, err = fmt.Fprintf(w, "%s\t%s\t%d\t%g\t%g\t%d\t%d\t%g\n",
+			s.class, k.name, k.bin, lower, upper, s.copies, s.expressed, s.density/float64(s.copies),
+		)
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	err = w.Flush()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+type byAge struct {
+	keys []ageKey
+	ages map[ageKey]*ageSummary
 }
 
+func (b byAge) Len() int { return len(b.keys) }
+func (b byAge) Less(i, j int) bool {
+	ci, cj := b.ages[b.keys[i]].class, b.ages[b.keys[j]].class
+	if ci != cj {
+		return ci < cj
+	}
+	if b.keys[i].name != b.keys[j].name {
+		return b.keys[i].name < b.keys[j].name
+	}
+	return b.keys[i].bin < b.keys[j].bin
+}
+func (b byAge) Swap(i, j int) { b.keys[i], b.keys[j] = b.keys[j], b.keys[i] }
+
 type intBam struct {
 	*boom.Record
 	uintptr
@@ -178,7 +362,7 @@ func main() {
 		os.Exit(1)
 	}
 
-	feats, err := annotFeats(annot, classes, names)
+	feats, ages, err := annotFeats(annot, classes, names)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
@@ -205,11 +389,7 @@ func main() {
 			rc++
 			if r.Flags()&boom.Unmapped == 0 {
 				feats[r.RefID()].DoMatching(func(iv interval.IntInterface) (done bool) {
-					f := iv.(intGff)
-					if f.FeatScore == nil {
-						f.FeatScore = new(float64)
-					}
-					*f.FeatScore += float64(r.Len())
+					*iv.(intGff).bases += r.Len()
 					return
 				}, intBam{r, id})
 			}
@@ -222,16 +402,33 @@ func main() {
 	for _, chr := range feats {
 		chr.Do(func(iv interval.IntInterface) (done bool) {
 			f := iv.(intGff)
-			if f.FeatScore == nil {
+			if *f.bases == 0 {
 				return
 			}
-			*f.FeatScore /= float64(rc) * float64(f.Len())
+			density := float64(*f.bases) / (float64(rc) * float64(f.Len()))
+			if age != "" {
+				s := ages[ageKey{f.name, f.bin}]
+				s.expressed++
+				s.density += density
+				f.FeatAttributes = append(f.FeatAttributes, gff.Attribute{Tag: "AgeBin", Value: strconv.Itoa(f.bin)})
+			}
+			// The output score is the read density; the
+			// annotation score is no longer needed.
+			f.FeatScore = &density
 			exp = append(exp, f.Feature)
 			return
 		})
 	}
 	sort.Sort(exp)
 
+	if ageTable != "" {
+		err = writeAgeTable(ageTable, ages)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
 	w := gff.NewWriter(os.Stdout, 60, false)
 	for _, f := range exp {
 		w.Write(f)
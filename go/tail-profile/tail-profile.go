@@ -0,0 +1,503 @@
+// Copyright ©2013 The bíogo Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// tail-profile reports non-templated 3' tailing of small RNA reads.
+//
+// In the absence of 2'-O-methylation piRNA 3' ends are subject to uridylation and adenylation.
+// The 3' tail of each alignment is identified as the soft-clipped bases at the read's 3' end
+// followed inward by up to a maximum number of contiguous terminal bases that mismatch the
+// reference, when a reference is given. Tails are classified by composition as U, A, C or G
+// when made of a single nucleotide, U-rich or A-rich when more than half of the tail is that
+// nucleotide, and mixed otherwise.
+//
+// Tailing frequencies are reported for each sample by read length, tail class, tail length and
+// annotation class, with frequencies given relative to the number of reads of the sample,
+// read length and annotation class.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/biogo/biogo/alphabet"
+	"github.com/biogo/biogo/io/featio"
+	"github.com/biogo/biogo/io/featio/gff"
+	"github.com/biogo/biogo/io/seqio"
+	"github.com/biogo/biogo/io/seqio/fasta"
+	"github.com/biogo/biogo/seq/linear"
+	"github.com/biogo/boom"
+	"github.com/biogo/store/interval"
+)
+
+var (
+	in set
+	ref,
+	annot,
+	out string
+	classes set
+
+	maxMismatch int
+	maxTail     int
+
+	minLength int
+	maxLength int
+
+	mapQ  int
+	mapQb byte
+)
+
+type set []string
+
+func (s *set) String() string {
+	if len(*s) == 0 {
+		return `""`
+	}
+	return strings.Join(*s, ",")
+}
+func (s *set) Set(value string) error {
+	*s = append(*s, strings.Split(value, ",")...)
+	if len(*s) == 0 {
+		return errors.New("empty set")
+	}
+	return nil
+}
+
+func annotOK(annot string, classes []string) bool {
+	if annot == "" && len(classes) == 0 {
+		return true
+	}
+	return annot != "" && len(classes) != 0
+}
+
+func init() {
+	flag.Var(&in, "in", "comma separated set of BAM files to be processed.")
+	flag.StringVar(&ref, "ref", "", "fasta file of the genome; required for mismatch tail detection.")
+	flag.StringVar(&annot, "annot", "", "file name of a GFF file containing annotations.")
+	flag.Var(&classes, "class", "comma separated set of annotation class globs to analyse.")
+	flag.StringVar(&out, "out", "", "outfile name (default stdout).")
+	flag.IntVar(&maxMismatch, "maxmm", 2, "maximum number of terminal mismatches included in a tail.")
+	flag.IntVar(&maxTail, "maxtail", 5, "tail length at and above which tails are reported together.")
+	flag.IntVar(&minLength, "min", 20, "minimum length read considered.")
+	flag.IntVar(&maxLength, "max", 35, "maximum length read considered.")
+	flag.IntVar(&mapQ, "mapQ", 0, "minimum mapping quality [0, 255).")
+	help := flag.Bool("help", false, "output this usage message.")
+	flag.Parse()
+	mapQb = byte(mapQ)
+	if *help {
+		flag.Usage()
+		os.Exit(0)
+	}
+	if len(in) == 0 || !annotOK(annot, classes) || maxMismatch < 0 || maxTail < 1 || mapQ < 0 || mapQ > 254 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if ref == "" {
+		maxMismatch = 0
+	}
+}
+
+// readRef returns the lower case sequences of the fasta file at path keyed by name.
+func readRef(path string) (map[string][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	seqs := make(map[string][]byte)
+	sc := seqio.NewScanner(fasta.NewReader(f, linear.NewSeq("", nil, alphabet.DNA)))
+	for sc.Next() {
+		s := sc.Seq().(*linear.Seq)
+		b := make([]byte, len(s.Seq))
+		for i, l := range s.Seq {
+			b[i] = byte(l) | ' '
+		}
+		seqs[s.Name()] = b
+	}
+	return seqs, sc.Error()
+}
+
+type intGff struct {
+	*gff.Feature
+	class string
+	uintptr
+}
+
+func (f intGff) Range() interval.IntRange { return interval.IntRange{f.Start(), f.End()} }
+func (f intGff) Overlap(b interval.IntRange) bool {
+	return f.Feature.FeatEnd > b.Start && f.Feature.FeatStart < b.End
+}
+func (f intGff) ID() uintptr { return f.uintptr }
+
+type intBam struct {
+	*boom.Record
+}
+
+func (f intBam) Range() interval.IntRange { return interval.IntRange{f.Start(), f.End()} }
+func (f intBam) Overlap(b interval.IntRange) bool {
+	return f.Start()+len(f.Seq()) > b.Start && f.Start() < b.End
+}
+func (f intBam) ID() uintptr { return 0 }
+
+// filterFeats returns interval trees of the features in annot matching classes, labelled
+// with the first class glob they match.
+func filterFeats(annot string, classes, names []string) ([]interval.IntTree, error) {
+	ntab := make(map[string]int, len(names))
+	for i, n := range names {
+		ntab[n] = i
+	}
+
+	ts := make([]interval.IntTree, len(names))
+
+	f, err := os.Open(annot)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fs := featio.NewScanner(gff.NewReader(f))
+	for id := uintptr(0); fs.Next(); id++ {
+		f := fs.Feat().(*gff.Feature)
+		var class string
+		if att := f.FeatAttributes.Get(f.Feature); att != "" {
+			// This gets the repeat attributes only.
+			fields := strings.Fields(att)
+			class = f.Feature + "/" + fields[1] + "/" + fields[0]
+		} else {
+			class = f.Feature
+		}
+		label, ok := classMatch(classes, class)
+		if !ok {
+			continue
+		}
+		if chr, ok := ntab[f.SeqName]; ok {
+			ts[chr].Insert(intGff{f, label, id}, true)
+		}
+	}
+	if err := fs.Error(); err != nil {
+		return nil, err
+	}
+	for i := range ts {
+		ts[i].AdjustRanges()
+	}
+
+	return ts, nil
+}
+
+// classMatch returns the first glob pattern in classes matching the slash separated
+// feature class path or any of its ancestors, and whether a match was found.
+func classMatch(classes []string, class string) (string, bool) {
+	for _, c := range classes {
+		for i := 0; i <= len(class); i++ {
+			if i < len(class) && class[i] != '/' {
+				continue
+			}
+			if ok, _ := path.Match(c, class[:i]); ok {
+				return c, true
+			}
+		}
+	}
+	return "", false
+}
+
+// tail returns the non-templated 3' tail of r in read orientation as lower case DNA.
+// Terminal mismatches are only considered if reference is not nil.
+func tail(r *boom.Record, reference []byte) []byte {
+	s := r.Seq()
+	cigar := r.Cigar()
+	if len(s) == 0 || len(cigar) == 0 {
+		return nil
+	}
+	if r.Flags()&boom.Reverse == 0 {
+		i := len(cigar) - 1
+		for i > 0 && cigar[i].Type() == boom.CigarHardClipped {
+			i--
+		}
+		n := 0
+		if cigar[i].Type() == boom.CigarSoftClipped {
+			n = cigar[i].Len()
+			i--
+		}
+		if reference != nil && i >= 0 && isAligned(cigar[i].Type()) {
+			clip := n
+			for q, p := len(s)-n-1, r.End()-1; q >= 0 && p >= 0 && p < len(reference) && n < clip+maxMismatch; q, p = q-1, p-1 {
+				if s[q]|' ' == reference[p] {
+					break
+				}
+				n++
+			}
+		}
+		t := make([]byte, n)
+		for k, b := range s[len(s)-n:] {
+			t[k] = b | ' '
+		}
+		return t
+	}
+
+	i := 0
+	for i < len(cigar)-1 && cigar[i].Type() == boom.CigarHardClipped {
+		i++
+	}
+	n := 0
+	if cigar[i].Type() == boom.CigarSoftClipped {
+		n = cigar[i].Len()
+		i++
+	}
+	if reference != nil && i < len(cigar) && isAligned(cigar[i].Type()) {
+		clip := n
+		for q, p := n, r.Start(); q < len(s) && p >= 0 && p < len(reference) && n < clip+maxMismatch; q, p = q+1, p+1 {
+			if s[q]|' ' == reference[p] {
+				break
+			}
+			n++
+		}
+	}
+	t := make([]byte, n)
+	for k := range t {
+		t[k] = complement[s[n-1-k]|' ']
+	}
+	return t
+}
+
+func isAligned(t boom.CigarOpType) bool {
+	return t == boom.CigarMatch || t == boom.CigarEqual || t == boom.CigarMismatch
+}
+
+var complement = [256]byte{'a': 't', 'c': 'g', 'g': 'c', 't': 'a', 'n': 'n'}
+
+// classify returns the composition class of the tail t.
+func classify(t []byte) string {
+	if len(t) == 0 {
+		return "none"
+	}
+	var c [256]int
+	for _, b := range t {
+		c[b]++
+	}
+	for _, b := range []byte("tacg") {
+		if c[b] == len(t) {
+			return strings.ToUpper(string(rnaBase(b)))
+		}
+	}
+	switch {
+	case 2*c['t'] > len(t):
+		return "U-rich"
+	case 2*c['a'] > len(t):
+		return "A-rich"
+	}
+	return "mixed"
+}
+
+func rnaBase(b byte) byte {
+	if b == 't' {
+		return 'u'
+	}
+	return b
+}
+
+// key identifies a read length and annotation class of a sample.
+type key struct {
+	sample string
+	class  string
+	length int
+}
+
+// tailKey identifies a tail class and length within a key.
+type tailKey struct {
+	key
+	tail   string
+	length int
+}
+
+func checkNames(files []string) ([]string, error) {
+	var names []string
+	for _, in := range files {
+		bf, err := boom.OpenBAM(in)
+		if err != nil {
+			return nil, err
+		}
+		if names != nil {
+			for i, n := range bf.RefNames() {
+				if names[i] != n {
+					return nil, errors.New("header mismatch")
+				}
+			}
+		}
+		names = bf.RefNames()
+		bf.Close()
+	}
+	return names, nil
+}
+
+func main() {
+	names, err := checkNames(in)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	var feats []interval.IntTree
+	if annot != "" {
+		feats, err = filterFeats(annot, classes, names)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	var seqs map[string][]byte
+	if ref != "" {
+		seqs, err = readRef(ref)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	var (
+		totals = make(map[key]int)
+		tails  = make(map[tailKey]int)
+	)
+	for _, f := range in {
+		err := profile(f, names, feats, seqs, totals, tails)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	var w io.Writer = os.Stdout
+	if out != "" {
+		f, err := os.Create(out)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		w = f
+	}
+	err = writeTSV(w, totals, tails)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// profile adds the tail counts of reads in the BAM file in to tails and the read
+// counts to totals. Reads are assigned to the classes of the features in feats they
+// overlap, or to "all" if feats is nil.
+func profile(in string, names []string, feats []interval.IntTree, seqs map[string][]byte, totals map[key]int, tails map[tailKey]int) error {
+	fmt.Fprintf(os.Stderr, "Reading %q\n", in)
+	bf, err := boom.OpenBAM(in)
+	if err != nil {
+		return err
+	}
+	defer bf.Close()
+
+	var hit []string
+	for {
+		r, _, err := bf.Read()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		if r.Flags()&boom.Unmapped != 0 || r.Score() < mapQb {
+			continue
+		}
+		l := len(r.Seq())
+		if l < minLength || l > maxLength {
+			continue
+		}
+
+		hit = hit[:0]
+		if feats == nil {
+			hit = append(hit, "all")
+		} else {
+			feats[r.RefID()].DoMatching(func(iv interval.IntInterface) (done bool) {
+				c := iv.(intGff).class
+				for _, h := range hit {
+					if h == c {
+						return
+					}
+				}
+				hit = append(hit, c)
+				return
+			}, intBam{r})
+		}
+		if len(hit) == 0 {
+			continue
+		}
+
+		var reference []byte
+		if seqs != nil {
+			reference = seqs[names[r.RefID()]]
+		}
+		t := tail(r, reference)
+		tl := len(t)
+		if tl > maxTail {
+			tl = maxTail
+		}
+		tc := classify(t)
+		for _, c := range hit {
+			k := key{sample: in, class: c, length: l}
+			totals[k]++
+			tails[tailKey{key: k, tail: tc, length: tl}]++
+		}
+	}
+
+	return nil
+}
+
+type byKey []tailKey
+
+func (k byKey) Len() int { return len(k) }
+func (k byKey) Less(i, j int) bool {
+	a, b := k[i], k[j]
+	switch {
+	case a.sample != b.sample:
+		return a.sample < b.sample
+	case a.class != b.class:
+		return a.class < b.class
+	case a.key.length != b.key.length:
+		return a.key.length < b.key.length
+	case a.tail != b.tail:
+		return a.tail < b.tail
+	}
+	return a.length < b.length
+}
+func (k byKey) Swap(i, j int) { k[i], k[j] = k[j], k[i] }
+
+func writeTSV(w io.Writer, totals map[key]int, tails map[tailKey]int) error {
+	keys := make([]tailKey, 0, len(tails))
+	for k := range tails {
+		keys = append(keys, k)
+	}
+	sort.Sort(byKey(keys))
+
+	bw := bufio.NewWriter(w)
+	_, err := fmt.Fprintln(bw, "sample\tclass\tlength\ttail\ttail-length\treads\ttotal\tfrequency")
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		tl := fmt.Sprint(k.length)
+		if k.length == maxTail {
+			tl += "+"
+		}
+		n, t := tails[k], totals[k.key]
+		_, err = fmt.Fprintf(bw, "%s\t%s\t%d\t%s\t%s\t%d\t%d\t%g\n",
+			k.sample, k.class, k.key.length, k.tail, tl, n, t, float64(n)/float64(t),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,636 @@
+// Copyright ©2013 The bíogo Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// te-expression relates transposon expression in long RNA-seq data to piRNA levels.
+//
+// Long RNA-seq fragments and small RNA reads from a pair of samples are counted against the
+// RepeatMasker copies in a GFF file. RNA-seq alignments are counted by fragment, merging the
+// aligned blocks of both mates of paired reads, and only the aligned blocks of spliced
+// alignments are used to test overlap with repeat copies. Counts are reported per subfamily,
+// named by the first field of the repeat attribute, and optionally per copy.
+//
+// For each subfamily and sample the Spearman correlation between RNA-seq and small RNA counts
+// over copies is reported, along with log2 fold changes between the second and first sample.
+// Spearman correlations between subfamily transcript and piRNA densities, and between their
+// fold changes, are written to the correlation summary.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/biogo/biogo/io/featio"
+	"github.com/biogo/biogo/io/featio/gff"
+	"github.com/biogo/boom"
+	"github.com/biogo/store/interval"
+)
+
+var (
+	rna,
+	small,
+	names pair
+	annot,
+	out,
+	copyOut,
+	corrOut string
+	classes set
+
+	mapQ  int
+	mapQb byte
+)
+
+type set []string
+
+func (s *set) String() string {
+	if len(*s) == 0 {
+		return `""`
+	}
+	return strings.Join(*s, ",")
+}
+func (s *set) Set(value string) error {
+	*s = append(*s, strings.Split(value, ",")...)
+	if len(*s) == 0 {
+		return errors.New("empty set")
+	}
+	return nil
+}
+
+type pair [2]string
+
+func (p *pair) String() string {
+	return fmt.Sprintf("%q,%q", p[0], p[1])
+}
+func (p *pair) Set(value string) error {
+	c := strings.Split(value, ",")
+	switch len(c) {
+	case 0:
+		return errors.New("empty pair")
+	case 2:
+		copy((*p)[:], c)
+		return nil
+	default:
+		return fmt.Errorf("unexpected number of elements: got %d expected 2", len(c))
+	}
+}
+
+func init() {
+	names = pair{"wt", "mut"}
+	flag.Var(&rna, "rna", "comma separated pair of long RNA-seq BAM files to be processed.")
+	flag.Var(&small, "small", "comma separated pair of small RNA BAM files to be processed.")
+	flag.Var(&names, "names", "comma separated pair of sample names used in column headers.")
+	flag.StringVar(&annot, "annot", "", "file name of a GFF file containing repeat annotations.")
+	flag.Var(&classes, "class", "comma separated set of annotation class globs to analyse (default all repeats).")
+	flag.StringVar(&out, "out", "", "subfamily outfile name (default stdout).")
+	flag.StringVar(&copyOut, "copies", "", "file name to write per copy counts to.")
+	flag.StringVar(&corrOut, "corr", "", "file name to write the correlation summary to (default stderr).")
+	flag.IntVar(&mapQ, "mapQ", 0, "minimum mapping quality [0, 255).")
+	help := flag.Bool("help", false, "output this usage message.")
+	flag.Parse()
+	mapQb = byte(mapQ)
+	if *help {
+		flag.Usage()
+		os.Exit(0)
+	}
+	if rna[0] == "" || rna[1] == "" || small[0] == "" || small[1] == "" || annot == "" || mapQ < 0 || mapQ > 254 {
+		flag.Usage()
+		os.Exit(1)
+	}
+}
+
+// repeatCopy is an annotated genomic copy of a repeat and its counts.
+type repeatCopy struct {
+	*gff.Feature
+	name, class string
+
+	// rna and small are the number of RNA-seq fragments
+	// and small RNA reads overlapping the copy in each
+	// sample.
+	rna, small [2]int
+}
+
+// family holds the copies and counts of a RepeatMasker subfamily.
+type family struct {
+	name, class string
+
+	copies []*repeatCopy
+	length int
+
+	// rna and small are the number of RNA-seq fragments and
+	// small RNA reads overlapping copies in each sample.
+	rna, small [2]int
+}
+
+type intGff struct {
+	*repeatCopy
+	uintptr
+}
+
+func (f intGff) Range() interval.IntRange { return interval.IntRange{f.Start(), f.End()} }
+func (f intGff) Overlap(b interval.IntRange) bool {
+	return f.Feature.FeatEnd > b.Start && f.Feature.FeatStart < b.End
+}
+func (f intGff) ID() uintptr { return f.uintptr }
+
+// block is an aligned reference interval of a read.
+type block struct {
+	ref        int
+	start, end int
+}
+
+func (b block) Range() interval.IntRange { return interval.IntRange{b.start, b.end} }
+func (b block) Overlap(r interval.IntRange) bool {
+	return b.end > r.Start && b.start < r.End
+}
+func (b block) ID() uintptr { return 0 }
+
+func annotFeats(annot string, classes, names []string) ([]interval.IntTree, map[string]*family, error) {
+	ntab := make(map[string]int, len(names))
+	for i, n := range names {
+		ntab[n] = i
+	}
+
+	ts := make([]interval.IntTree, len(names))
+
+	fams := make(map[string]*family)
+
+	f, err := os.Open(annot)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	fs := featio.NewScanner(gff.NewReader(f))
+	for id := uintptr(0); fs.Next(); id++ {
+		f := fs.Feat().(*gff.Feature)
+		att := f.FeatAttributes.Get("repeat")
+		if att == "" {
+			// Ignore non-repeat features.
+			continue
+		}
+		fields := strings.Fields(att)
+		if len(fields) < 2 {
+			continue
+		}
+		if len(classes) != 0 && !classMatch(classes, f.Feature+"/"+fields[1]+"/"+fields[0]) {
+			continue
+		}
+		chr, ok := ntab[f.SeqName]
+		if !ok {
+			continue
+		}
+		c := &repeatCopy{Feature: f, name: fields[0], class: fields[1]}
+		ts[chr].Insert(intGff{c, id}, true)
+
+		fam, ok := fams[c.name]
+		if !ok {
+			fam = &family{name: c.name, class: c.class}
+			fams[c.name] = fam
+		}
+		fam.copies = append(fam.copies, c)
+		fam.length += f.Len()
+	}
+	if err := fs.Error(); err != nil {
+		return nil, nil, err
+	}
+	for i := range ts {
+		ts[i].AdjustRanges()
+	}
+
+	return ts, fams, nil
+}
+
+// classMatch returns whether class or any of its ancestors matches a glob in classes.
+func classMatch(classes []string, class string) bool {
+	for i := 0; i <= len(class); i++ {
+		if i < len(class) && class[i] != '/' {
+			continue
+		}
+		for _, c := range classes {
+			if ok, _ := path.Match(c, class[:i]); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func checkNames(files []string) ([]string, error) {
+	var names []string
+	for _, in := range files {
+		bf, err := boom.OpenBAM(in)
+		if err != nil {
+			return nil, err
+		}
+		if names != nil {
+			for i, n := range bf.RefNames() {
+				if names[i] != n {
+					return nil, errors.New("header mismatch")
+				}
+			}
+		}
+		names = bf.RefNames()
+		bf.Close()
+	}
+	return names, nil
+}
+
+// blocks appends the aligned reference blocks of r to dst, splitting spliced
+// alignments at skipped regions.
+func blocks(dst []block, r *boom.Record) []block {
+	ref := r.RefID()
+	pos := r.Start()
+	start := pos
+	for _, c := range r.Cigar() {
+		switch c.Type() {
+		case boom.CigarMatch, boom.CigarEqual, boom.CigarMismatch, boom.CigarDeletion:
+			pos += c.Len()
+		case boom.CigarSkipped:
+			if pos > start {
+				dst = append(dst, block{ref, start, pos})
+			}
+			pos += c.Len()
+			start = pos
+		}
+	}
+	if pos > start {
+		dst = append(dst, block{ref, start, pos})
+	}
+	return dst
+}
+
+// count adds the fragments or reads in the BAM file in overlapping repeat copies to the
+// counts for sample i and returns the number of mapped fragments or reads. If spliced is
+// true, the file is treated as long RNA-seq data, otherwise as small RNA data. The blocks
+// of paired mates are merged so that each fragment is counted once, including fragments
+// with only one mate passing the filters.
+func count(in string, i int, spliced bool, feats []interval.IntTree, fams map[string]*family) (int, error) {
+	fmt.Fprintf(os.Stderr, "Reading %q\n", in)
+	bf, err := boom.OpenBAM(in)
+	if err != nil {
+		return 0, err
+	}
+	defer bf.Close()
+
+	var (
+		total  int
+		hit    = make(map[string]struct{})
+		copies = make(map[*repeatCopy]struct{})
+		mates  = make(map[string][]block)
+		bs     []block
+	)
+	tally := func(bs []block) {
+		total++
+
+		for k := range hit {
+			delete(hit, k)
+		}
+		for k := range copies {
+			delete(copies, k)
+		}
+		for _, b := range bs {
+			feats[b.ref].DoMatching(func(iv interval.IntInterface) (done bool) {
+				c := iv.(intGff).repeatCopy
+				if _, ok := copies[c]; !ok {
+					copies[c] = struct{}{}
+					if spliced {
+						c.rna[i]++
+					} else {
+						c.small[i]++
+					}
+				}
+				if _, ok := hit[c.name]; !ok {
+					hit[c.name] = struct{}{}
+					if spliced {
+						fams[c.name].rna[i]++
+					} else {
+						fams[c.name].small[i]++
+					}
+				}
+				return
+			}, b)
+		}
+	}
+	for {
+		r, _, err := bf.Read()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return 0, err
+		}
+		flags := r.Flags()
+		if flags&(boom.Unmapped|boom.Secondary) != 0 || r.Score() < mapQb {
+			continue
+		}
+		if !spliced {
+			tally(append(bs[:0], block{r.RefID(), r.Start(), r.End()}))
+			continue
+		}
+		if flags&boom.Paired == 0 || flags&boom.MateUnmapped != 0 {
+			tally(blocks(bs[:0], r))
+			continue
+		}
+		m, ok := mates[r.Name()]
+		if !ok {
+			// Hold the first seen mate until
+			// its partner is read.
+			mates[r.Name()] = blocks(nil, r)
+			continue
+		}
+		delete(mates, r.Name())
+		tally(blocks(m, r))
+	}
+	// Fragments with a mate that did not
+	// pass the filters are counted alone.
+	for _, m := range mates {
+		tally(m)
+	}
+
+	return total, nil
+}
+
+// density returns the reads per kb per million mapped reads of n reads on length bases.
+func density(n, length, total int) float64 {
+	if total == 0 || length == 0 {
+		return 0
+	}
+	return float64(n) * 1e9 / (float64(total) * float64(length))
+}
+
+// log2Fold returns the log2 ratio of the per million counts b and a of totals tb and ta
+// calculated with a pseudocount of half a read.
+func log2Fold(a, b, ta, tb int) float64 {
+	if ta == 0 || tb == 0 {
+		return math.NaN()
+	}
+	return math.Log2(((float64(b) + 0.5) / float64(tb)) / ((float64(a) + 0.5) / float64(ta)))
+}
+
+// ranks returns the ranks of the values in x, with ties given their mean rank.
+func ranks(x []float64) []float64 {
+	idx := make([]int, len(x))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.Sort(byValue{idx, x})
+	r := make([]float64, len(x))
+	for i := 0; i < len(idx); {
+		j := i + 1
+		for j < len(idx) && x[idx[j]] == x[idx[i]] {
+			j++
+		}
+		rank := float64(i+j+1) / 2
+		for _, k := range idx[i:j] {
+			r[k] = rank
+		}
+		i = j
+	}
+	return r
+}
+
+type byValue struct {
+	idx []int
+	x   []float64
+}
+
+func (b byValue) Len() int           { return len(b.idx) }
+func (b byValue) Less(i, j int) bool { return b.x[b.idx[i]] < b.x[b.idx[j]] }
+func (b byValue) Swap(i, j int)      { b.idx[i], b.idx[j] = b.idx[j], b.idx[i] }
+
+// pearson returns the Pearson correlation of x and y.
+func pearson(x, y []float64) float64 {
+	n := float64(len(x))
+	if n < 2 {
+		return math.NaN()
+	}
+	var mx, my float64
+	for i := range x {
+		mx += x[i]
+		my += y[i]
+	}
+	mx /= n
+	my /= n
+	var sxy, sxx, syy float64
+	for i := range x {
+		dx, dy := x[i]-mx, y[i]-my
+		sxy += dx * dy
+		sxx += dx * dx
+		syy += dy * dy
+	}
+	if sxx == 0 || syy == 0 {
+		return math.NaN()
+	}
+	return sxy / math.Sqrt(sxx*syy)
+}
+
+// spearman returns the Spearman rank correlation of x and y, skipping pairs
+// where either value is NaN.
+func spearman(x, y []float64) float64 {
+	var fx, fy []float64
+	for i := range x {
+		if math.IsNaN(x[i]) || math.IsNaN(y[i]) {
+			continue
+		}
+		fx = append(fx, x[i])
+		fy = append(fy, y[i])
+	}
+	return pearson(ranks(fx), ranks(fy))
+}
+
+func main() {
+	refs, err := checkNames(append(rna[:], small[:]...))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	feats, fams, err := annotFeats(annot, classes, refs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	var rnaTotal, smallTotal [2]int
+	for i := range names {
+		rnaTotal[i], err = count(rna[i], i, true, feats, fams)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		smallTotal[i], err = count(small[i], i, false, feats, fams)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	sorted := make([]*family, 0, len(fams))
+	for _, f := range fams {
+		sorted = append(sorted, f)
+	}
+	sort.Sort(byClass(sorted))
+
+	var w io.Writer = os.Stdout
+	if out != "" {
+		f, err := os.Create(out)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		w = f
+	}
+	err = writeFamilies(w, sorted, rnaTotal, smallTotal)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if copyOut != "" {
+		err = writeCopies(copyOut, sorted)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	w = os.Stderr
+	if corrOut != "" {
+		f, err := os.Create(corrOut)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		w = f
+	}
+	err = writeCorrelations(w, sorted, rnaTotal, smallTotal)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+type byClass []*family
+
+func (f byClass) Len() int { return len(f) }
+func (f byClass) Less(i, j int) bool {
+	if f[i].class != f[j].class {
+		return f[i].class < f[j].class
+	}
+	return f[i].name < f[j].name
+}
+func (f byClass) Swap(i, j int) { f[i], f[j] = f[j], f[i] }
+
+// copyCorrelation returns the Spearman correlation between the RNA-seq and
+// small RNA counts of the copies of f in sample i.
+func (f *family) copyCorrelation(i int) float64 {
+	x := make([]float64, len(f.copies))
+	y := make([]float64, len(f.copies))
+	for k, c := range f.copies {
+		x[k] = float64(c.rna[i])
+		y[k] = float64(c.small[i])
+	}
+	return spearman(x, y)
+}
+
+func writeFamilies(w io.Writer, fams []*family, rnaTotal, smallTotal [2]int) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprint(bw, "class\ttype\tcopies\tlength")
+	for _, n := range names {
+		fmt.Fprintf(bw, "\t%[1]s-rna\t%[1]s-rna-fpkm\t%[1]s-small\t%[1]s-small-rpkm\t%[1]s-copy-correlation", n)
+	}
+	_, err := fmt.Fprintln(bw, "\trna-log2-fold-change\tsmall-log2-fold-change")
+	if err != nil {
+		return err
+	}
+	for _, f := range fams {
+		fmt.Fprintf(bw, "%s\t%s\t%d\t%d", f.class, f.name, len(f.copies), f.length)
+		for i := range names {
+			fmt.Fprintf(bw, "\t%d\t%g\t%d\t%g\t%g",
+				f.rna[i], density(f.rna[i], f.length, rnaTotal[i]),
+				f.small[i], density(f.small[i], f.length, smallTotal[i]),
+				f.copyCorrelation(i),
+			)
+		}
+		_, err = fmt.Fprintf(bw, "\t%g\t%g\n",
+			log2Fold(f.rna[0], f.rna[1], rnaTotal[0], rnaTotal[1]),
+			log2Fold(f.small[0], f.small[1], smallTotal[0], smallTotal[1]),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func writeCopies(path string, fams []*family) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	fmt.Fprint(bw, "chrom\tstart\tend\tstrand\tclass\ttype")
+	for _, n := range names {
+		fmt.Fprintf(bw, "\t%[1]s-rna\t%[1]s-small", n)
+	}
+	_, err = fmt.Fprintln(bw)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	for _, fam := range fams {
+		for _, c := range fam.copies {
+			fmt.Fprintf(bw, "%s\t%d\t%d\t%s\t%s\t%s", c.SeqName, c.FeatStart, c.FeatEnd, c.FeatStrand, c.class, c.name)
+			for i := range names {
+				fmt.Fprintf(bw, "\t%d\t%d", c.rna[i], c.small[i])
+			}
+			_, err = fmt.Fprintln(bw)
+			if err != nil {
+				f.Close()
+				return err
+			}
+		}
+	}
+	err = bw.Flush()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeCorrelations writes the Spearman correlations over subfamilies between transcript
+// and piRNA densities in each sample and between their fold changes.
+func writeCorrelations(w io.Writer, fams []*family, rnaTotal, smallTotal [2]int) error {
+	_, err := fmt.Fprintln(w, "comparison\tsubfamilies\tspearman")
+	if err != nil {
+		return err
+	}
+	x := make([]float64, len(fams))
+	y := make([]float64, len(fams))
+	for i, n := range names {
+		for k, f := range fams {
+			x[k] = density(f.rna[i], f.length, rnaTotal[i])
+			y[k] = density(f.small[i], f.length, smallTotal[i])
+		}
+		_, err = fmt.Fprintf(w, "%s-rna-vs-small\t%d\t%g\n", n, len(fams), spearman(x, y))
+		if err != nil {
+			return err
+		}
+	}
+	for k, f := range fams {
+		x[k] = log2Fold(f.rna[0], f.rna[1], rnaTotal[0], rnaTotal[1])
+		y[k] = log2Fold(f.small[0], f.small[1], smallTotal[0], smallTotal[1])
+	}
+	_, err = fmt.Fprintf(w, "%s-%s-change-rna-vs-small\t%d\t%g\n", names[0], names[1], len(fams), spearman(x, y))
+	return err
+}
@@ -11,6 +11,7 @@ import (
 	"io"
 	"math"
 	"os"
+	"path"
 	"strings"
 	"unsafe"
 
@@ -180,11 +181,6 @@ func filterFeats(annot string, classes, names []string, thresh float64) ([]inter
 
 	ts := make([]interval.IntTree, len(names))
 
-	cm := make(map[string]struct{})
-	for _, c := range classes {
-		cm[c] = struct{}{}
-	}
-
 	f, err := os.Open(annot)
 	if err != nil {
 		return nil, err
@@ -198,18 +194,13 @@ func filterFeats(annot string, classes, names []string, thresh float64) ([]inter
 		var class string
 		if att := f.FeatAttributes.Get(f.Feature); att != "" {
 			// This gets the repeat attributes only.
-			class = f.Feature + "/" + strings.Fields(att)[1]
+			fields := strings.Fields(att)
+			class = f.Feature + "/" + fields[1] + "/" + fields[0]
 		} else {
 			class = f.Feature
 		}
-		if _, ok := cm[class]; !ok {
-			last := strings.LastIndex(class, "/")
-			if last == strings.Index(class, "/") {
-				continue
-			}
-			if _, ok := cm[class[:last]]; !ok {
-				continue
-			}
+		if !classMatch(classes, class) {
+			continue
 		}
 		if chr, ok := ntab[f.SeqName]; ok {
 			ts[chr].Insert(intGff{f}, true)
@@ -225,6 +216,21 @@ func filterFeats(annot string, classes, names []string, thresh float64) ([]inter
 	return ts, nil
 }
 
+// classMatch returns whether class or any of its ancestors matches a glob in classes.
+func classMatch(classes []string, class string) bool {
+	for i := 0; i <= len(class); i++ {
+		if i < len(class) && class[i] != '/' {
+			continue
+		}
+		for _, c := range classes {
+			if ok, _ := path.Match(c, class[:i]); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 type intBam struct {
 	*boom.Record
 }